@@ -0,0 +1,276 @@
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/settings"
+)
+
+const (
+	// referrers are user controlled, so their number must be limited
+	maxReferrers = 20
+)
+
+type Kind int
+
+const (
+	View Kind = iota
+	Download
+)
+
+var (
+	st        = &store{data: map[string]*Stats{}}
+	statsFile string
+)
+
+type Stats struct {
+	Views      int64            `json:"views"`
+	Downloads  int64            `json:"downloads"`
+	LastAccess *time.Time       `json:"last_access,omitempty"`
+	Referrers  map[string]int64 `json:"referrers,omitempty"`
+}
+
+func (s *Stats) copy() *Stats {
+	rv := &Stats{
+		Views:     s.Views,
+		Downloads: s.Downloads,
+	}
+	if s.LastAccess != nil {
+		t := *s.LastAccess
+		rv.LastAccess = &t
+	}
+	if s.Referrers != nil {
+		rv.Referrers = map[string]int64{}
+		for k, v := range s.Referrers {
+			rv.Referrers[k] = v
+		}
+	}
+	return rv
+}
+
+type store struct {
+	data      map[string]*Stats
+	dirty     bool
+	referrers bool
+	m         sync.Mutex
+}
+
+func Init(ctx context.Context) error {
+	s, err := settings.Get()
+	if err != nil {
+		return err
+	}
+
+	st.m.Lock()
+	st.referrers = s.AccessStatsReferrers
+	st.m.Unlock()
+
+	filedata.Subscribe(func(e *filedata.Event) {
+		if e.Removed() {
+			st.m.Lock()
+			if _, ok := st.data[e.File.GetId()]; ok {
+				delete(st.data, e.File.GetId())
+				st.dirty = true
+			}
+			st.m.Unlock()
+		}
+	})
+
+	if s.AccessStatsFile == "" {
+		return nil
+	}
+
+	if err := load(s.AccessStatsFile); err != nil {
+		return err
+	}
+
+	statsFile = s.AccessStatsFile
+	go saveLoop(ctx, s.AccessStatsFile, s.AccessStatsSaveInterval)
+	return nil
+}
+
+// Close saves the statistics, if enabled.
+func Close() error {
+	if statsFile == "" {
+		return nil
+	}
+	return save(statsFile)
+}
+
+func load(fn string) error {
+	data := map[string]*Stats{}
+
+	fp, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+
+	if err := json.NewDecoder(fp).Decode(&data); err != nil {
+		return err
+	}
+
+	// files deleted while filebin was not running
+	ids := map[string]bool{}
+	filedata.ForEach(func(fd *filedata.FileData) {
+		ids[fd.GetId()] = true
+	})
+
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	for id, s := range data {
+		if s == nil {
+			continue
+		}
+		if !ids[id] {
+			st.dirty = true
+			continue
+		}
+		st.data[id] = s
+	}
+	return nil
+}
+
+func save(fn string) error {
+	st.m.Lock()
+	if !st.dirty {
+		st.m.Unlock()
+		return nil
+	}
+	data := make(map[string]*Stats, len(st.data))
+	for id, s := range st.data {
+		data[id] = s.copy()
+	}
+	st.dirty = false
+	st.m.Unlock()
+
+	// the previous file is replaced atomically, to not lose everything if
+	// filebin is killed while writing.
+	fp, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fp).Encode(data)
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+
+		st.m.Lock()
+		st.dirty = true
+		st.m.Unlock()
+		return err
+	}
+	return nil
+}
+
+func saveLoop(ctx context.Context, fn string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := save(fn); err != nil {
+				log.Printf("error: access: %s", err)
+			}
+		}
+	}
+}
+
+func referrer(r *http.Request) string {
+	ref := r.Referer()
+	if ref == "" {
+		return ""
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" || strings.EqualFold(u.Host, r.Host) {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// Record records an access to a file. HEAD requests and requests for
+// ranges that do not start at the beginning of the file are ignored, so
+// that clients resuming downloads or seeking media are not counted again.
+func Record(fd *filedata.FileData, kind Kind, r *http.Request) {
+	if r.Method != http.MethodGet {
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	// not tracking accesses to files that were deleted in the meantime,
+	// otherwise they would never be removed from the store. delete events
+	// are emitted after the file is unregistered, so checking while locked
+	// is enough.
+	if !fd.Registered() {
+		return
+	}
+
+	s, ok := st.data[fd.GetId()]
+	if !ok {
+		s = &Stats{}
+		st.data[fd.GetId()] = s
+	}
+
+	switch kind {
+	case View:
+		s.Views++
+	case Download:
+		s.Downloads++
+	}
+	s.LastAccess = &now
+
+	if st.referrers {
+		if ref := referrer(r); ref != "" {
+			if s.Referrers == nil {
+				s.Referrers = map[string]int64{}
+			}
+			if _, ok := s.Referrers[ref]; ok || len(s.Referrers) < maxReferrers {
+				s.Referrers[ref]++
+			}
+		}
+	}
+
+	st.dirty = true
+}
+
+// Get returns a copy of the access statistics of a file.
+func Get(fd *filedata.FileData) *Stats {
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	if s, ok := st.data[fd.GetId()]; ok {
+		return s.copy()
+	}
+	return &Stats{}
+}
@@ -0,0 +1,424 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/rangereader"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/utils"
+)
+
+type AzureOptions struct {
+	AccountName string
+	AccountKey  string
+	Endpoint    string
+	Container   string
+	SASExpire   time.Duration
+	ProxyData   bool
+}
+
+type Azure struct {
+	c         *container.Client
+	cred      *container.SharedKeyCredential
+	container string
+	protocol  sas.Protocol
+	expire    time.Duration
+	proxy     bool
+}
+
+func NewAzure(options AzureOptions) (*Azure, error) {
+	cred, err := container.NewSharedKeyCredential(options.AccountName, options.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the endpoint is only required for emulators or sovereign clouds
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", options.AccountName)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := sas.ProtocolHTTPS
+	if u.Scheme == "http" {
+		protocol = sas.ProtocolHTTPSandHTTP
+	}
+
+	c, err := container.NewClientWithSharedKeyCredential(strings.TrimRight(endpoint, "/")+"/"+url.PathEscape(options.Container), cred, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Azure{
+		c:         c,
+		cred:      cred,
+		container: options.Container,
+		protocol:  protocol,
+		expire:    options.SASExpire,
+		proxy:     options.ProxyData,
+	}, nil
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func etagAny() *azcore.ETag {
+	e := azcore.ETagAny
+	return &e
+}
+
+func isNotFound(err error) bool {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return true
+	}
+
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusNotFound
+}
+
+// metadata keys are returned with the case changed by the http client
+func getMetadata(md map[string]*string, key string) (string, bool) {
+	for k, v := range md {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
+func (a *Azure) Name() string {
+	return "Azure"
+}
+
+func (a *Azure) List(ctx context.Context) ([]string, error) {
+	rv := []string{}
+
+	pager := a.c.NewListBlobsFlatPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range page.Segment.BlobItems {
+			if b.Name != nil && !strings.Contains(*b.Name, "/") {
+				rv = append(rv, *b.Name)
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+func (a *Azure) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	res, err := a.c.NewBlobClient(id).DownloadStream(ctx, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (a *Azure) ReadRange(ctx context.Context, id string, offset int64) (io.ReadCloser, error) {
+	res, err := a.c.NewBlobClient(id).DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: offset},
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (a *Azure) ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error) {
+	res, err := a.c.NewBlobClient(id).GetProperties(ctx, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+
+	rv := &metadata.Metadata{}
+
+	if v, ok := getMetadata(res.Metadata, "filename"); ok {
+		filename, err := base64.URLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Filename = string(filename)
+	}
+
+	if v, ok := getMetadata(res.Metadata, "mimetype"); ok {
+		rv.Mimetype = v
+	}
+
+	if v := res.ContentLength; v != nil {
+		rv.Size = *v
+	}
+
+	if v, ok := getMetadata(res.Metadata, "timestamp"); ok {
+		if err := rv.Timestamp.UnmarshalText([]byte(v)); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := getMetadata(res.Metadata, "description"); ok {
+		description, err := base64.URLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Description = string(description)
+	}
+
+	if v, ok := getMetadata(res.Metadata, "tags"); ok && v != "" {
+		rv.Tags = strings.Split(v, ",")
+	}
+
+	return rv, nil
+}
+
+func encodeMetadata(m *metadata.Metadata) (map[string]*string, error) {
+	ts, err := m.Timestamp.UTC().MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]*string{
+		"filename":  str(base64.URLEncoding.EncodeToString([]byte(m.Filename))),
+		"mimetype":  str(m.Mimetype),
+		"timestamp": str(string(ts)),
+	}
+	if m.Description != "" {
+		rv["description"] = str(base64.URLEncoding.EncodeToString([]byte(m.Description)))
+	}
+	if len(m.Tags) > 0 {
+		rv["tags"] = str(strings.Join(m.Tags, ","))
+	}
+	return rv, nil
+}
+
+func (a *Azure) Write(ctx context.Context, id string, r io.Reader, m *metadata.Metadata) (int64, error) {
+	md, err := encodeMetadata(m)
+	if err != nil {
+		return 0, err
+	}
+
+	cr := &utils.CountingReader{R: r}
+
+	conf := &blockblob.UploadStreamOptions{
+		HTTPHeaders: &blob.HTTPHeaders{
+			BlobContentType: str(m.Mimetype),
+		},
+		Metadata: md,
+
+		// never overwrite existing blobs
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+				IfNoneMatch: etagAny(),
+			},
+		},
+	}
+
+	if _, err := a.c.NewBlockBlobClient(id).UploadStream(ctx, cr, conf); err != nil {
+		if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+			return 0, os.ErrExist
+		}
+		return 0, err
+	}
+
+	return cr.N, nil
+}
+
+func (a *Azure) Delete(ctx context.Context, id string) error {
+	if _, err := a.c.NewBlobClient(id).Delete(ctx, nil); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *Azure) WriteMetadata(ctx context.Context, id string, m *metadata.Metadata) error {
+	md, err := encodeMetadata(m)
+	if err != nil {
+		return err
+	}
+
+	bc := a.c.NewBlobClient(id)
+	if _, err := bc.SetMetadata(ctx, md, nil); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+
+	_, err = bc.SetHTTPHeaders(ctx, blob.HTTPHeaders{
+		BlobContentType: str(m.Mimetype),
+	}, nil)
+	return err
+}
+
+// Quarantine moves the blob to a "quarantine/" directory, that is ignored by
+// List.
+func (a *Azure) Quarantine(ctx context.Context, id string) error {
+	src := a.c.NewBlobClient(id)
+	dst := a.c.NewBlobClient("quarantine/" + id)
+
+	// copies inside the same storage account are usually synchronous
+	res, err := dst.StartCopyFromURL(ctx, src.URL(), nil)
+	if err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+
+	status := res.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("azure: quarantine: copy %s", *status)
+	}
+
+	return a.Delete(ctx, id)
+}
+
+func (a *Azure) serveData(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	bc := a.c.NewBlobClient(id)
+
+	props, err := bc.GetProperties(ctx, nil)
+	if err != nil {
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return nil
+		}
+		return err
+	}
+
+	size := int64(0)
+	if v := props.ContentLength; v != nil {
+		size = *v
+	}
+
+	// make sure that all the ranges are read from the same blob version
+	conditions := &blob.AccessConditions{}
+	if v := props.ETag; v != nil && *v != "" {
+		w.Header().Set("ETag", string(*v))
+		conditions.ModifiedAccessConditions = &blob.ModifiedAccessConditions{
+			IfMatch: v,
+		}
+	}
+
+	if timestamp.IsZero() && props.LastModified != nil {
+		timestamp = *props.LastModified
+	}
+
+	if mimetype != "" {
+		w.Header().Set("Content-Type", mimetype)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if filename != "" {
+		if attachment {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		} else {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		}
+	}
+
+	rs := rangereader.New(size, func(offset int64) (io.ReadCloser, error) {
+		res, err := bc.DownloadStream(ctx, &blob.DownloadStreamOptions{
+			Range:            blob.HTTPRange{Offset: offset},
+			AccessConditions: conditions,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.Body, nil
+	})
+	defer rs.Close()
+
+	// ServeContent handles range and conditional requests
+	http.ServeContent(w, r, filename, timestamp, rs)
+	return nil
+}
+
+func (a *Azure) redirectData(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, attachment bool) error {
+	conf := sas.BlobSignatureValues{
+		Protocol:      a.protocol,
+		ExpiryTime:    time.Now().UTC().Add(a.expire),
+		Permissions:   (&sas.BlobPermissions{Read: true}).String(),
+		ContainerName: a.container,
+		BlobName:      id,
+		ContentType:   mimetype,
+	}
+	if filename != "" {
+		if attachment {
+			conf.ContentDisposition = fmt.Sprintf(`attachment; filename="%s"`, filename)
+		} else {
+			conf.ContentDisposition = fmt.Sprintf(`inline; filename="%s"`, filename)
+		}
+	}
+
+	qp, err := conf.SignWithSharedKey(a.cred)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, a.c.NewBlobClient(id).URL()+"?"+qp.Encode(), http.StatusFound)
+	return nil
+}
+
+func (a *Azure) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	switch r.Method {
+	case http.MethodHead:
+		// HEAD requests are always proxied
+		return a.serveData(ctx, w, r, id, filename, mimetype, timestamp, attachment)
+
+	case http.MethodGet:
+		if a.proxy {
+			return a.serveData(ctx, w, r, id, filename, mimetype, timestamp, attachment)
+		}
+		return a.redirectData(w, r, id, filename, mimetype, attachment)
+
+	default:
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+}
@@ -0,0 +1,496 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+)
+
+type fakeBlob struct {
+	data        []byte
+	contentType string
+	metadata    http.Header
+	etag        string
+	modified    time.Time
+}
+
+// fakeStorage implements the subset of the blob service api used by the
+// backend, for a single container. Authentication is not validated.
+type fakeStorage struct {
+	container string
+	blobs     map[string]*fakeBlob
+	blocks    map[string]map[string][]byte
+	etag      int
+	m         sync.Mutex
+}
+
+func newFakeStorage(t *testing.T, container string) *httptest.Server {
+	f := &fakeStorage{
+		container: container,
+		blobs:     map[string]*fakeBlob{},
+		blocks:    map[string]map[string][]byte{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func storageError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func metadataHeaders(h http.Header) http.Header {
+	rv := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			rv[k] = v
+		}
+	}
+	return rv
+}
+
+func (f *fakeStorage) newEtag() string {
+	f.etag++
+	return fmt.Sprintf(`"0x%d"`, f.etag)
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	q := r.URL.Query()
+	p := strings.TrimPrefix(r.URL.Path, "/"+f.container)
+
+	if p == "" {
+		if r.Method == http.MethodGet && q.Get("comp") == "list" {
+			f.list(w)
+			return
+		}
+		storageError(w, http.StatusBadRequest, "UnsupportedOperation")
+		return
+	}
+	name := strings.TrimPrefix(p, "/")
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		storageError(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+
+	b, exists := f.blobs[name]
+
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		if f.blocks[name] == nil {
+			f.blocks[name] = map[string][]byte{}
+		}
+		f.blocks[name][q.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && q.Get("comp") == "" && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			storageError(w, http.StatusConflict, "BlobAlreadyExists")
+			return
+		}
+		f.put(w, r, name, body)
+
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			storageError(w, http.StatusConflict, "BlobAlreadyExists")
+			return
+		}
+
+		bl := struct {
+			Ids []string `xml:",any"`
+		}{}
+		if err := xml.Unmarshal(body, &bl); err != nil {
+			storageError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		data := []byte{}
+		for _, id := range bl.Ids {
+			block, ok := f.blocks[name][id]
+			if !ok {
+				storageError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(f.blocks, name)
+		f.put(w, r, name, data)
+
+	case r.Method == http.MethodPut && q.Get("comp") == "metadata":
+		if !exists {
+			storageError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		b.metadata = metadataHeaders(r.Header)
+		b.etag = f.newEtag()
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPut && q.Get("comp") == "properties":
+		if !exists {
+			storageError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		b.contentType = r.Header.Get("x-ms-blob-content-type")
+		b.etag = f.newEtag()
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-copy-source") != "":
+		u, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+		if err != nil {
+			storageError(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		src, ok := f.blobs[strings.TrimPrefix(u.Path, "/"+f.container+"/")]
+		if !ok {
+			storageError(w, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		c := *src
+		c.etag = f.newEtag()
+		f.blobs[name] = &c
+		w.Header().Set("x-ms-copy-id", "copy")
+		w.Header().Set("x-ms-copy-status", "success")
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodDelete:
+		if !exists {
+			storageError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if !exists {
+			storageError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if v := r.Header.Get("If-Match"); v != "" && v != b.etag {
+			storageError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+			return
+		}
+
+		for k, v := range b.metadata {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Type", b.contentType)
+		w.Header().Set("ETag", b.etag)
+		w.Header().Set("Last-Modified", b.modified.Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+
+		data := b.data
+		status := http.StatusOK
+		rng := r.Header.Get("x-ms-range")
+		if rng == "" {
+			rng = r.Header.Get("Range")
+		}
+		if rng != "" && r.Method == http.MethodGet {
+			var start, end int64
+			spec := strings.TrimPrefix(rng, "bytes=")
+			parts := strings.SplitN(spec, "-", 2)
+			start, _ = strconv.ParseInt(parts[0], 10, 64)
+			end = int64(len(data)) - 1
+			if len(parts) == 2 && parts[1] != "" {
+				end, _ = strconv.ParseInt(parts[1], 10, 64)
+			}
+			if start > end || start >= int64(len(data)) {
+				storageError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	default:
+		storageError(w, http.StatusBadRequest, "UnsupportedOperation")
+	}
+}
+
+func (f *fakeStorage) put(w http.ResponseWriter, r *http.Request, name string, data []byte) {
+	f.blobs[name] = &fakeBlob{
+		data:        data,
+		contentType: r.Header.Get("x-ms-blob-content-type"),
+		metadata:    metadataHeaders(r.Header),
+		etag:        f.newEtag(),
+		modified:    time.Now().UTC().Truncate(time.Second),
+	}
+	w.Header().Set("ETag", f.blobs[name].etag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeStorage) list(w http.ResponseWriter) {
+	names := []string{}
+	for name := range f.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="%s"><Blobs>`, f.container)
+	for _, name := range names {
+		fmt.Fprintf(buf, `<Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length><BlobType>BlockBlob</BlobType></Properties></Blob>`, name, len(f.blobs[name].data))
+	}
+	fmt.Fprint(buf, `</Blobs><NextMarker /></EnumerationResults>`)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+}
+
+func newTestAzure(t *testing.T, proxy bool) *Azure {
+	t.Helper()
+
+	srv := newFakeStorage(t, "filebin")
+	a, err := NewAzure(AzureOptions{
+		AccountName: "account",
+		AccountKey:  base64.StdEncoding.EncodeToString([]byte("key")),
+		Endpoint:    srv.URL,
+		Container:   "filebin",
+		SASExpire:   5 * time.Minute,
+		ProxyData:   proxy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAzure(t *testing.T) {
+	a := newTestAzure(t, false)
+	ctx := context.Background()
+
+	m := &metadata.Metadata{
+		Filename:    "fóo bar.txt",
+		Mimetype:    "text/plain",
+		Timestamp:   time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Description: "multi\nline",
+		Tags:        []string{"a", "b"},
+	}
+
+	n, err := a.Write(ctx, "foo", bytes.NewBufferString("hello world"), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 11 {
+		t.Errorf("unexpected size: %d", n)
+	}
+
+	if _, err := a.Write(ctx, "foo", bytes.NewBufferString("bola"), m); !os.IsExist(err) {
+		t.Errorf("expected ErrExist, got %v", err)
+	}
+
+	if _, err := a.Write(ctx, "bar", bytes.NewBufferString("bola"), m); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := a.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"bar", "foo"}) {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+
+	md, err := a.ReadMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Size = 11
+	if !reflect.DeepEqual(md, m) {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+
+	if _, err := a.ReadMetadata(ctx, "baz"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	fp, err := a.Read(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fp)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	fp, err = a.ReadRange(ctx, "foo", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(fp)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "world" {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	if _, err := a.Read(ctx, "baz"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	m.Mimetype = "text/x-go"
+	m.Description = ""
+	m.Tags = nil
+	if err := a.WriteMetadata(ctx, "foo", m); err != nil {
+		t.Fatal(err)
+	}
+	md, err = a.ReadMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md, m) {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+	if err := a.WriteMetadata(ctx, "baz", m); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	if err := a.Delete(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete(ctx, "bar"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// quarantined blobs are not listed
+	if err := a.Quarantine(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Quarantine(ctx, "foo"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	ids, err = a.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+	if _, err := a.ReadMetadata(ctx, "quarantine/foo"); err != nil {
+		t.Errorf("blob not quarantined: %s", err)
+	}
+}
+
+func TestAzureWriteBlocks(t *testing.T) {
+	a := newTestAzure(t, false)
+	ctx := context.Background()
+
+	// uploads larger than a block are staged and committed
+	data := bytes.Repeat([]byte("bola"), 1<<20)
+	n, err := a.Write(ctx, "foo", bytes.NewReader(data), &metadata.Metadata{Mimetype: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("unexpected size: %d", n)
+	}
+
+	fp, err := a.Read(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdata, err := ioutil.ReadAll(fp)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rdata, data) {
+		t.Error("unexpected data")
+	}
+
+	if _, err := a.Write(ctx, "foo", bytes.NewReader(data), &metadata.Metadata{}); !os.IsExist(err) {
+		t.Errorf("expected ErrExist, got %v", err)
+	}
+}
+
+func TestAzureServe(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	a := newTestAzure(t, true)
+	if _, err := a.Write(ctx, "foo", bytes.NewBufferString("hello world"), &metadata.Metadata{Mimetype: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Range", "bytes=6-")
+	rec := httptest.NewRecorder()
+	if err := a.Serve(ctx, rec, req, "foo", "foo.txt", "text/plain", ts, true); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "world" {
+		t.Errorf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+	if v := rec.Header().Get("Content-Disposition"); v != `attachment; filename="foo.txt"` {
+		t.Errorf("unexpected content disposition: %s", v)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := a.Serve(ctx, rec, httptest.NewRequest(http.MethodGet, "/baz", nil), "baz", "", "text/plain", ts, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// without proxy, clients are redirected to a signed url, but HEAD
+	// requests are still proxied
+	a.proxy = false
+
+	rec = httptest.NewRecorder()
+	if err := a.Serve(ctx, rec, httptest.NewRequest(http.MethodGet, "/foo", nil), "foo", "foo.txt", "text/plain", ts, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusFound {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/filebin/foo" || u.Query().Get("sig") == "" || u.Query().Get("rscd") != `inline; filename="foo.txt"` {
+		t.Errorf("unexpected redirect: %s", u)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := a.Serve(ctx, rec, httptest.NewRequest(http.MethodHead, "/foo", nil), "foo", "foo.txt", "text/plain", ts, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "11" {
+		t.Errorf("unexpected response: %d %s", rec.Code, rec.Header().Get("Content-Length"))
+	}
+}
@@ -1,28 +1,168 @@
 package backends
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/azure"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/gcs"
 	"github.com/rafaelmartins/filebin/internal/filedata/backends/local"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/memory"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
 	"github.com/rafaelmartins/filebin/internal/filedata/backends/s3"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/sftp"
 )
 
 type Backend interface {
 	Name() string
-	List() ([]string, error)
-	Read(id string) (io.ReadCloser, error)
-	ReadMetadata(id string) (string, string, int64, time.Time, error)
-	Write(id string, r io.ReadSeeker, filename string, mimetype string) (int64, error)
-	Delete(id string) error
-	Serve(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error
+	List(ctx context.Context) ([]string, error)
+	Read(ctx context.Context, id string) (io.ReadCloser, error)
+	ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error)
+	Write(ctx context.Context, id string, r io.Reader, m *metadata.Metadata) (int64, error)
+	Delete(ctx context.Context, id string) error
+	Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error
 }
 
-func Lookup(dir string, s3Options s3.S3Options) (Backend, error) {
+// DirectUploader is implemented by backends that allow clients to upload
+// files straight to the storage, using presigned POST requests. The metadata
+// of pending uploads is stored with the uploaded data, and returned by
+// PeekUpload.
+type DirectUploader interface {
+	PresignUpload(ctx context.Context, id string, size int64, m *metadata.Metadata) (string, map[string]string, error)
+	PeekUpload(ctx context.Context, id string, n int64) (*metadata.Metadata, []byte, error)
+	FinalizeUpload(ctx context.Context, id string, m *metadata.Metadata) error
+	DiscardUpload(ctx context.Context, id string) error
+	ListUploads(ctx context.Context) (map[string]time.Time, error)
+}
+
+// OrphanLister is implemented by backends that store data and metadata
+// separately, to find data files without metadata, that are not returned by
+// List.
+type OrphanLister interface {
+	ListOrphans(ctx context.Context) ([]string, error)
+}
+
+// MetadataWriter is implemented by backends that can replace the metadata of
+// existing files.
+type MetadataWriter interface {
+	WriteMetadata(ctx context.Context, id string, m *metadata.Metadata) error
+}
+
+// Quarantiner is implemented by backends that can move broken files out of
+// the way, without deleting them. Quarantined files are not returned by List
+// anymore.
+type Quarantiner interface {
+	Quarantine(ctx context.Context, id string) error
+}
+
+// RangeReader is implemented by remote backends that can read files starting
+// at an offset, without downloading the data before it.
+type RangeReader interface {
+	ReadRange(ctx context.Context, id string, offset int64) (io.ReadCloser, error)
+}
+
+// ReadRange reads a file starting at offset. The data before the offset is
+// skipped if the backend does not support ranged reads.
+func ReadRange(ctx context.Context, b Backend, id string, offset int64) (io.ReadCloser, error) {
+	if c, ok := b.(*cached); ok {
+		if fp, ok := c.c.Get(id); ok {
+			return skip(fp, offset)
+		}
+	}
+
+	if rr, ok := Unwrap(b).(RangeReader); ok {
+		return rr.ReadRange(ctx, id, offset)
+	}
+
+	fp, err := Unwrap(b).Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return skip(fp, offset)
+}
+
+func skip(fp io.ReadCloser, offset int64) (io.ReadCloser, error) {
+	if s, ok := fp.(io.Seeker); ok {
+		if _, err := s.Seek(offset, io.SeekStart); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		return fp, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, fp, offset); err != nil && err != io.EOF {
+		fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// Quarantine moves a file to the quarantine, if supported by the backend.
+func Quarantine(ctx context.Context, b Backend, id string) error {
+	q, ok := Unwrap(b).(Quarantiner)
+	if !ok {
+		return fmt.Errorf("backends: %s backend does not support quarantine", b.Name())
+	}
+
+	// the id may be reused by new uploads
+	if c, ok := b.(*cached); ok {
+		c.c.Remove(id)
+	}
+	return q.Quarantine(ctx, id)
+}
+
+func Lookup(inMemory bool, dir string, s3Options s3.S3Options, azureOptions azure.AzureOptions, gcsOptions gcs.GCSOptions, sftpOptions sftp.SFTPOptions, cacheDir string, cacheMaxSize int64) (Backend, error) {
+	if inMemory {
+		return memory.NewMemory()
+	}
+
 	if s3Options.AccessKeyId != "" && s3Options.SecretAccessKey != "" && s3Options.Region != "" && s3Options.Bucket != "" {
-		return s3.NewS3(s3Options)
+		b, err := s3.NewS3(s3Options)
+		if err != nil {
+			return nil, err
+		}
+		if cacheDir != "" {
+			return newCached(b, cacheDir, cacheMaxSize)
+		}
+		return b, nil
+	}
+
+	if azureOptions.AccountName != "" && azureOptions.AccountKey != "" && azureOptions.Container != "" {
+		b, err := azure.NewAzure(azureOptions)
+		if err != nil {
+			return nil, err
+		}
+		if cacheDir != "" {
+			return newCached(b, cacheDir, cacheMaxSize)
+		}
+		return b, nil
+	}
+
+	if gcsOptions.Bucket != "" {
+		b, err := gcs.NewGCS(gcsOptions)
+		if err != nil {
+			return nil, err
+		}
+		if cacheDir != "" {
+			return newCached(b, cacheDir, cacheMaxSize)
+		}
+		return b, nil
+	}
+
+	if sftpOptions.Host != "" && sftpOptions.Dir != "" {
+		b, err := sftp.NewSFTP(sftpOptions)
+		if err != nil {
+			return nil, err
+		}
+		if cacheDir != "" {
+			return newCached(b, cacheDir, cacheMaxSize)
+		}
+		return b, nil
 	}
 
 	if dir != "" {
@@ -31,3 +171,54 @@ func Lookup(dir string, s3Options s3.S3Options) (Backend, error) {
 
 	return nil, errors.New("filedata: no data backend configured")
 }
+
+// LookupSpec creates a backend from a command line specification, e.g.
+// "local:/path/to/dir", "s3", "azure", "gcs" or "sftp".
+func LookupSpec(spec string, s3Options s3.S3Options, azureOptions azure.AzureOptions, gcsOptions gcs.GCSOptions, sftpOptions sftp.SFTPOptions) (Backend, error) {
+	pieces := strings.SplitN(spec, ":", 2)
+	switch pieces[0] {
+	case "local":
+		if len(pieces) != 2 || pieces[1] == "" {
+			return nil, errors.New("backends: local backend requires a directory, e.g. local:/path/to/dir")
+		}
+		return local.NewLocal(pieces[1])
+
+	case "s3":
+		if len(pieces) != 1 {
+			return nil, errors.New("backends: s3 backend is configured using environment variables")
+		}
+		if s3Options.AccessKeyId == "" || s3Options.SecretAccessKey == "" || s3Options.Region == "" || s3Options.Bucket == "" {
+			return nil, errors.New("backends: s3 backend not configured")
+		}
+		return s3.NewS3(s3Options)
+
+	case "azure":
+		if len(pieces) != 1 {
+			return nil, errors.New("backends: azure backend is configured using environment variables")
+		}
+		if azureOptions.AccountName == "" || azureOptions.AccountKey == "" || azureOptions.Container == "" {
+			return nil, errors.New("backends: azure backend not configured")
+		}
+		return azure.NewAzure(azureOptions)
+
+	case "gcs":
+		if len(pieces) != 1 {
+			return nil, errors.New("backends: gcs backend is configured using environment variables")
+		}
+		if gcsOptions.Bucket == "" {
+			return nil, errors.New("backends: gcs backend not configured")
+		}
+		return gcs.NewGCS(gcsOptions)
+
+	case "sftp":
+		if len(pieces) != 1 {
+			return nil, errors.New("backends: sftp backend is configured using environment variables")
+		}
+		if sftpOptions.Host == "" || sftpOptions.Dir == "" {
+			return nil, errors.New("backends: sftp backend not configured")
+		}
+		return sftp.NewSFTP(sftpOptions)
+	}
+
+	return nil, fmt.Errorf("backends: invalid backend: %s", spec)
+}
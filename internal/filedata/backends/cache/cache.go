@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Cache is a size limited, least recently used store of blobs on local disk.
+// Blobs are write-once, so entries are never invalidated, only evicted.
+type Cache struct {
+	dir     string
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	m       sync.Mutex
+}
+
+type entry struct {
+	id   string
+	size int64
+}
+
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("cache: invalid maximum size")
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// oldest first, so that the most recently used entries end up in the front
+	sort.Slice(files, func(i int, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// leftovers from interrupted writes
+		if strings.HasPrefix(file.Name(), ".") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+
+		c.entries[file.Name()] = c.lru.PushFront(&entry{id: file.Name(), size: file.Size()})
+		c.size += file.Size()
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.evict()
+
+	return c, nil
+}
+
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.id)
+	c.size -= e.size
+	os.Remove(filepath.Join(c.dir, e.id))
+}
+
+func (c *Cache) Get(id string) (io.ReadCloser, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	fp, err := os.Open(filepath.Join(c.dir, id))
+	if err != nil {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return fp, true
+}
+
+func (c *Cache) Remove(id string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+}
+
+// Tee returns a reader that stores the data read from r in the cache. The
+// entry is only added if r is read until EOF before being closed.
+func (c *Cache) Tee(id string, r io.ReadCloser) io.ReadCloser {
+	fp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return r
+	}
+
+	return &teeReader{
+		c:  c,
+		id: id,
+		r:  r,
+		fp: fp,
+	}
+}
+
+func (c *Cache) commit(id string, fn string, size int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.entries[id]; ok || size > c.maxSize {
+		os.Remove(fn)
+		return
+	}
+
+	if err := os.Rename(fn, filepath.Join(c.dir, id)); err != nil {
+		os.Remove(fn)
+		return
+	}
+
+	c.entries[id] = c.lru.PushFront(&entry{id: id, size: size})
+	c.size += size
+	c.evict()
+}
+
+type teeReader struct {
+	c      *Cache
+	id     string
+	r      io.ReadCloser
+	fp     *os.File
+	size   int64
+	failed bool
+	eof    bool
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 && !t.failed {
+		t.size += int64(n)
+		if t.size > t.c.maxSize {
+			t.failed = true
+		} else if _, err := t.fp.Write(p[:n]); err != nil {
+			t.failed = true
+		}
+	}
+	if err == io.EOF {
+		t.eof = true
+	}
+	return n, err
+}
+
+func (t *teeReader) Close() error {
+	err := t.r.Close()
+
+	fn := t.fp.Name()
+	if err2 := t.fp.Close(); err2 != nil {
+		t.failed = true
+	}
+
+	if err != nil || t.failed || !t.eof {
+		os.Remove(fn)
+		return err
+	}
+
+	t.c.commit(t.id, fn, t.size)
+	return nil
+}
@@ -0,0 +1,51 @@
+package backends
+
+import (
+	"context"
+	"io"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/cache"
+)
+
+type cached struct {
+	Backend
+	c *cache.Cache
+}
+
+func newCached(b Backend, dir string, maxSize int64) (Backend, error) {
+	c, err := cache.NewCache(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &cached{Backend: b, c: c}, nil
+}
+
+// Unwrap returns the backend wrapped by the cache, if any, so that optional
+// interfaces can be detected.
+func Unwrap(b Backend) Backend {
+	if c, ok := b.(*cached); ok {
+		return c.Backend
+	}
+	return b
+}
+
+func (c *cached) Name() string {
+	return c.Backend.Name() + " (cached)"
+}
+
+func (c *cached) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	if fp, ok := c.c.Get(id); ok {
+		return fp, nil
+	}
+
+	fp, err := c.Backend.Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.c.Tee(id, fp), nil
+}
+
+func (c *cached) Delete(ctx context.Context, id string) error {
+	c.c.Remove(id)
+	return c.Backend.Delete(ctx, id)
+}
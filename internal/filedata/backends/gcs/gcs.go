@@ -0,0 +1,395 @@
+package gcs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/rangereader"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+type GCSOptions struct {
+	CredentialsFile string
+	Endpoint        string
+	Bucket          string
+	Prefix          string
+	SignedUrlExpire time.Duration
+	ProxyData       bool
+}
+
+type GCS struct {
+	c        *storage.Client
+	b        *storage.BucketHandle
+	prefix   string
+	expire   time.Duration
+	proxy    bool
+	insecure bool
+}
+
+func NewGCS(options GCSOptions) (*GCS, error) {
+	opts := []option.ClientOption{}
+	proxy := options.ProxyData
+	insecure := false
+
+	if options.CredentialsFile != "" {
+		opts = append(opts, option.WithAuthCredentialsFile(option.ServiceAccount, options.CredentialsFile))
+	}
+
+	if options.Endpoint != "" {
+		u, err := url.Parse(options.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		insecure = u.Scheme == "http"
+
+		opts = append(opts, option.WithEndpoint(options.Endpoint))
+
+		// emulators, like fake-gcs-server, don't support authentication, and
+		// urls can't be signed without credentials
+		if options.CredentialsFile == "" {
+			opts = append(opts, option.WithoutAuthentication())
+			proxy = true
+		}
+	}
+
+	c, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the prefix works like a directory, so that filebin does not try to
+	// handle unrelated objects stored in the same bucket.
+	prefix := strings.TrimLeft(options.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &GCS{
+		c:        c,
+		b:        c.Bucket(options.Bucket),
+		prefix:   prefix,
+		expire:   options.SignedUrlExpire,
+		proxy:    proxy,
+		insecure: insecure,
+	}, nil
+}
+
+func isNotFound(err error) bool {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return true
+	}
+
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+func (g *GCS) object(id string) *storage.ObjectHandle {
+	return g.b.Object(g.prefix + id)
+}
+
+func (g *GCS) Name() string {
+	return "GCS"
+}
+
+func (g *GCS) List(ctx context.Context) ([]string, error) {
+	query := &storage.Query{
+		Prefix:    g.prefix,
+		Delimiter: "/",
+	}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+
+	it := g.b.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// "directories" are returned with an empty name
+		if strings.HasPrefix(attrs.Name, g.prefix) && len(attrs.Name) > len(g.prefix) {
+			rv = append(rv, attrs.Name[len(g.prefix):])
+		}
+	}
+
+	return rv, nil
+}
+
+func (g *GCS) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	r, err := g.object(id).NewReader(ctx)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func (g *GCS) ReadRange(ctx context.Context, id string, offset int64) (io.ReadCloser, error) {
+	r, err := g.object(id).NewRangeReader(ctx, offset, -1)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func (g *GCS) ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error) {
+	attrs, err := g.object(id).Attrs(ctx)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+
+	rv := &metadata.Metadata{
+		Size: attrs.Size,
+	}
+
+	if v, ok := attrs.Metadata["filename"]; ok {
+		filename, err := base64.URLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Filename = string(filename)
+	}
+
+	if v, ok := attrs.Metadata["mimetype"]; ok {
+		rv.Mimetype = v
+	}
+
+	if v, ok := attrs.Metadata["timestamp"]; ok {
+		if err := rv.Timestamp.UnmarshalText([]byte(v)); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := attrs.Metadata["description"]; ok {
+		description, err := base64.URLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Description = string(description)
+	}
+
+	if v, ok := attrs.Metadata["tags"]; ok && v != "" {
+		rv.Tags = strings.Split(v, ",")
+	}
+
+	return rv, nil
+}
+
+func getMetadata(m *metadata.Metadata) (map[string]string, error) {
+	ts, err := m.Timestamp.UTC().MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{
+		"filename":  base64.URLEncoding.EncodeToString([]byte(m.Filename)),
+		"mimetype":  m.Mimetype,
+		"timestamp": string(ts),
+	}
+	if m.Description != "" {
+		rv["description"] = base64.URLEncoding.EncodeToString([]byte(m.Description))
+	}
+	if len(m.Tags) > 0 {
+		rv["tags"] = strings.Join(m.Tags, ",")
+	}
+	return rv, nil
+}
+
+func (g *GCS) Write(ctx context.Context, id string, r io.Reader, m *metadata.Metadata) (int64, error) {
+	md, err := getMetadata(m)
+	if err != nil {
+		return 0, err
+	}
+
+	// canceling the context is the only way to abort an upload
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// never overwrite existing objects
+	w := g.object(id).If(storage.Conditions{DoesNotExist: true}).NewWriter(wctx)
+	w.ContentType = m.Mimetype
+	w.Metadata = md
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		cancel()
+		w.Close()
+		return 0, err
+	}
+
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			return 0, os.ErrExist
+		}
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (g *GCS) Delete(ctx context.Context, id string) error {
+	if err := g.object(id).Delete(ctx); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	return nil
+}
+
+func (g *GCS) WriteMetadata(ctx context.Context, id string, m *metadata.Metadata) error {
+	md, err := getMetadata(m)
+	if err != nil {
+		return err
+	}
+
+	// metadata is merged on updates, so removed values are replaced by empty
+	// ones, that are ignored by ReadMetadata
+	for _, k := range []string{"description", "tags"} {
+		if _, ok := md[k]; !ok {
+			md[k] = ""
+		}
+	}
+
+	if _, err := g.object(id).Update(ctx, storage.ObjectAttrsToUpdate{
+		ContentType: m.Mimetype,
+		Metadata:    md,
+	}); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	return nil
+}
+
+// Quarantine moves the object to a "quarantine/" prefix, that is ignored by
+// List.
+func (g *GCS) Quarantine(ctx context.Context, id string) error {
+	if _, err := g.b.Object(g.prefix + "quarantine/" + id).CopierFrom(g.object(id)).Run(ctx); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	return g.Delete(ctx, id)
+}
+
+func (g *GCS) serveData(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	attrs, err := g.object(id).Attrs(ctx)
+	if err != nil {
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return nil
+		}
+		return err
+	}
+
+	// make sure that all the ranges are read from the same object generation
+	obj := g.object(id).Generation(attrs.Generation)
+
+	if attrs.Etag != "" {
+		w.Header().Set("ETag", attrs.Etag)
+	}
+	if timestamp.IsZero() {
+		timestamp = attrs.Updated
+	}
+
+	if mimetype != "" {
+		w.Header().Set("Content-Type", mimetype)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if filename != "" {
+		if attachment {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		} else {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		}
+	}
+
+	rs := rangereader.New(attrs.Size, func(offset int64) (io.ReadCloser, error) {
+		return obj.NewRangeReader(ctx, offset, -1)
+	})
+	defer rs.Close()
+
+	// ServeContent handles range and conditional requests
+	http.ServeContent(w, r, filename, timestamp, rs)
+	return nil
+}
+
+func (g *GCS) redirectData(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, attachment bool) error {
+	qs := url.Values{}
+	if mimetype != "" {
+		qs.Set("response-content-type", mimetype)
+	}
+	if filename != "" {
+		if attachment {
+			qs.Set("response-content-disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		} else {
+			qs.Set("response-content-disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		}
+	}
+
+	u, err := g.b.SignedURL(g.prefix+id, &storage.SignedURLOptions{
+		Method:          http.MethodGet,
+		Expires:         time.Now().Add(g.expire),
+		Scheme:          storage.SigningSchemeV4,
+		QueryParameters: qs,
+		Insecure:        g.insecure,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, u, http.StatusFound)
+	return nil
+}
+
+func (g *GCS) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	switch r.Method {
+	case http.MethodHead:
+		// HEAD requests are always proxied
+		return g.serveData(ctx, w, r, id, filename, mimetype, timestamp, attachment)
+
+	case http.MethodGet:
+		if g.proxy {
+			return g.serveData(ctx, w, r, id, filename, mimetype, timestamp, attachment)
+		}
+		return g.redirectData(w, r, id, filename, mimetype, attachment)
+
+	default:
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+}
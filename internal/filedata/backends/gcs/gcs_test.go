@@ -0,0 +1,506 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+)
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	generation  int64
+	updated     time.Time
+}
+
+// fakeStorage implements the subset of the json and xml apis used by the
+// backend, for a single bucket, like fake-gcs-server.
+type fakeStorage struct {
+	bucket     string
+	objects    map[string]*fakeObject
+	generation int64
+	m          sync.Mutex
+}
+
+func newFakeStorage(t *testing.T, bucket string) (*fakeStorage, *httptest.Server) {
+	f := &fakeStorage{
+		bucket:  bucket,
+		objects: map[string]*fakeObject{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func storageError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": http.StatusText(status),
+		},
+	})
+}
+
+func (f *fakeStorage) resource(name string) map[string]interface{} {
+	o := f.objects[name]
+	return map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         f.bucket,
+		"name":           name,
+		"size":           strconv.Itoa(len(o.data)),
+		"contentType":    o.contentType,
+		"metadata":       o.metadata,
+		"generation":     strconv.FormatInt(o.generation, 10),
+		"metageneration": "1",
+		"etag":           fmt.Sprintf("etag%d", o.generation),
+		"updated":        o.updated.Format(time.RFC3339Nano),
+	}
+}
+
+func (f *fakeStorage) store(name string, o *fakeObject) {
+	f.generation++
+	o.generation = f.generation
+	o.updated = time.Now().UTC().Truncate(time.Second)
+	f.objects[name] = o
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	// object names include slashes, that are escaped in the path
+	parts := strings.Split(r.URL.EscapedPath(), "/")
+	for i, p := range parts {
+		parts[i], _ = url.PathUnescape(p)
+	}
+
+	switch {
+	case len(parts) == 7 && parts[1] == "upload" && r.Method == http.MethodPost:
+		f.upload(w, r)
+
+	case len(parts) == 6 && parts[1] == "storage" && parts[5] == "o" && r.Method == http.MethodGet:
+		f.list(w, r)
+
+	case len(parts) == 12 && parts[1] == "storage" && parts[7] == "rewriteTo" && r.Method == http.MethodPost:
+		src, ok := f.objects[parts[6]]
+		if !ok {
+			storageError(w, http.StatusNotFound)
+			return
+		}
+		c := *src
+		f.store(parts[11], &c)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":                "storage#rewriteResponse",
+			"totalBytesRewritten": strconv.Itoa(len(c.data)),
+			"objectSize":          strconv.Itoa(len(c.data)),
+			"done":                true,
+			"resource":            f.resource(parts[11]),
+		})
+
+	case len(parts) == 7 && parts[1] == "storage":
+		name := parts[6]
+		o, ok := f.objects[name]
+		if !ok {
+			storageError(w, http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(f.resource(name))
+
+		case http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodPatch:
+			attrs := struct {
+				ContentType string             `json:"contentType"`
+				Metadata    map[string]*string `json:"metadata"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+				storageError(w, http.StatusBadRequest)
+				return
+			}
+			if attrs.ContentType != "" {
+				o.contentType = attrs.ContentType
+			}
+			for k, v := range attrs.Metadata {
+				if v == nil {
+					delete(o.metadata, k)
+				} else {
+					o.metadata[k] = *v
+				}
+			}
+			json.NewEncoder(w).Encode(f.resource(name))
+
+		default:
+			storageError(w, http.StatusMethodNotAllowed)
+		}
+
+	case len(parts) == 3 && parts[1] == f.bucket && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		f.read(w, r, parts[2])
+
+	default:
+		storageError(w, http.StatusBadRequest)
+	}
+}
+
+func (f *fakeStorage) upload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		storageError(w, http.StatusNotImplemented)
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		storageError(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	p, err := mr.NextPart()
+	if err != nil {
+		storageError(w, http.StatusBadRequest)
+		return
+	}
+	attrs := struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}{}
+	if err := json.NewDecoder(p).Decode(&attrs); err != nil {
+		storageError(w, http.StatusBadRequest)
+		return
+	}
+
+	p, err = mr.NextPart()
+	if err != nil {
+		storageError(w, http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(p)
+	if err != nil {
+		storageError(w, http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := f.objects[attrs.Name]; ok && r.URL.Query().Get("ifGenerationMatch") == "0" {
+		storageError(w, http.StatusPreconditionFailed)
+		return
+	}
+	if attrs.Metadata == nil {
+		attrs.Metadata = map[string]string{}
+	}
+
+	f.store(attrs.Name, &fakeObject{
+		data:        data,
+		contentType: attrs.ContentType,
+		metadata:    attrs.Metadata,
+	})
+	json.NewEncoder(w).Encode(f.resource(attrs.Name))
+}
+
+func (f *fakeStorage) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	names := []string{}
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := []map[string]interface{}{}
+	prefixes := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				if p := name[:len(prefix)+i+1]; !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		items = append(items, f.resource(name))
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":     "storage#objects",
+		"items":    items,
+		"prefixes": prefixes,
+	})
+}
+
+func (f *fakeStorage) read(w http.ResponseWriter, r *http.Request, name string) {
+	o, ok := f.objects[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if v := r.URL.Query().Get("generation"); v != "" && v != strconv.FormatInt(o.generation, 10) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", o.contentType)
+	w.Header().Set("Last-Modified", o.updated.Format(http.TimeFormat))
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+
+	data := o.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"), 10, 64)
+		if err != nil || start >= int64(len(data)) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		data = data[start:]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func newTestGCS(t *testing.T) (*GCS, *fakeStorage) {
+	t.Helper()
+
+	f, srv := newFakeStorage(t, "bucket")
+	g, err := NewGCS(GCSOptions{
+		Endpoint: srv.URL + "/storage/v1/",
+		Bucket:   "bucket",
+		Prefix:   "filebin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, f
+}
+
+func readAll(t *testing.T, fp io.ReadCloser, err error) string {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	data, err := ioutil.ReadAll(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGCS(t *testing.T) {
+	g, f := newTestGCS(t)
+	ctx := context.Background()
+
+	// objects out of the prefix are ignored
+	f.store("unrelated", &fakeObject{data: []byte("bola")})
+	f.store("filebin/thumbnails/foo", &fakeObject{data: []byte("bola")})
+
+	m := &metadata.Metadata{
+		Filename:    "fóo bar.txt",
+		Mimetype:    "text/plain",
+		Timestamp:   time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Description: "multi\nline",
+		Tags:        []string{"a", "b"},
+	}
+
+	n, err := g.Write(ctx, "foo", bytes.NewBufferString("hello world"), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 11 {
+		t.Errorf("unexpected size: %d", n)
+	}
+
+	if _, err := g.Write(ctx, "foo", bytes.NewBufferString("bola"), m); !os.IsExist(err) {
+		t.Errorf("expected ErrExist, got %v", err)
+	}
+
+	if _, err := g.Write(ctx, "bar", bytes.NewBufferString("bola"), m); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := g.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"bar", "foo"}) {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+
+	md, err := g.ReadMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Size = 11
+	if !reflect.DeepEqual(md, m) {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+
+	if _, err := g.ReadMetadata(ctx, "baz"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	fp, err := g.Read(ctx, "foo")
+	if data := readAll(t, fp, err); data != "hello world" {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	fp, err = g.ReadRange(ctx, "foo", 6)
+	if data := readAll(t, fp, err); data != "world" {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	if _, err := g.Read(ctx, "baz"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// removed values are cleared
+	m.Mimetype = "text/x-go"
+	m.Description = ""
+	m.Tags = nil
+	if err := g.WriteMetadata(ctx, "foo", m); err != nil {
+		t.Fatal(err)
+	}
+	md, err = g.ReadMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md, m) {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+	for _, k := range []string{"description", "tags"} {
+		if v := f.objects["filebin/foo"].metadata[k]; v != "" {
+			t.Errorf("metadata not cleared: %s: %q", k, v)
+		}
+	}
+	if v := f.objects["filebin/foo"].contentType; v != "text/x-go" {
+		t.Errorf("unexpected content type: %s", v)
+	}
+	if err := g.WriteMetadata(ctx, "baz", m); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	if err := g.Delete(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Delete(ctx, "bar"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// quarantined objects are not listed
+	if err := g.Quarantine(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Quarantine(ctx, "foo"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if o, ok := f.objects["filebin/quarantine/foo"]; !ok || string(o.data) != "hello world" {
+		t.Error("object not quarantined")
+	}
+	ids, err = g.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+}
+
+func TestGCSServe(t *testing.T) {
+	g, _ := newTestGCS(t)
+	ctx := context.Background()
+	ts := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// emulators can't sign urls, so data is always proxied
+	if !g.proxy {
+		t.Fatal("data not proxied")
+	}
+
+	if _, err := g.Write(ctx, "foo", bytes.NewBufferString("hello world"), &metadata.Metadata{Mimetype: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rng    string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, "hello world"},
+		{"bytes=6-", http.StatusPartialContent, "world"},
+		{"bytes=0-4", http.StatusPartialContent, "hello"},
+		{"bytes=-3", http.StatusPartialContent, "rld"},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		rec := httptest.NewRecorder()
+		if err := g.Serve(ctx, rec, req, "foo", "foo.txt", "text/plain", ts, true); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tc.status {
+			t.Errorf("%q: unexpected status: %d", tc.rng, rec.Code)
+		}
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Errorf("%q: unexpected body: %q", tc.rng, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	if err := g.Serve(ctx, rec, httptest.NewRequest(http.MethodHead, "/foo", nil), "foo", "foo.txt", "text/plain", ts, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "11" {
+		t.Errorf("unexpected response: %d %s", rec.Code, rec.Header().Get("Content-Length"))
+	}
+	if v := rec.Header().Get("Content-Disposition"); v != `inline; filename="foo.txt"` {
+		t.Errorf("unexpected content disposition: %s", v)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := g.Serve(ctx, rec, httptest.NewRequest(http.MethodGet, "/baz", nil), "baz", "", "text/plain", ts, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
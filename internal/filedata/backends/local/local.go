@@ -1,6 +1,7 @@
 package local
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,16 +11,39 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/utils"
 )
 
 type Local struct {
 	dir string
 }
 
-type metadata struct {
-	Filename  string    `json:"filename"`
-	Mimetype  string    `json:"mimetype"`
-	Timestamp time.Time `json:"timestamp"`
+type localFS struct{}
+
+func (localFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (localFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (localFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0777)
+}
+
+func (localFS) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
 }
 
 func NewLocal(dir string) (*Local, error) {
@@ -46,50 +70,30 @@ func (l *Local) Name() string {
 	return "Local"
 }
 
-func (l *Local) List() ([]string, error) {
-	files, err := ioutil.ReadDir(l.dir)
-	if err != nil {
+func (l *Local) List(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	rv := []string{}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		if fn := file.Name(); filepath.Ext(fn) == ".json" {
-			rv = append(rv, fn[:len(fn)-5])
-		}
-	}
-	return rv, nil
+	return utils.List(localFS{}, l.dir)
 }
 
-func (l *Local) Read(id string) (io.ReadCloser, error) {
+func (l *Local) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return os.Open(filepath.Join(l.dir, id))
 }
 
-func (l *Local) ReadMetadata(id string) (string, string, int64, time.Time, error) {
-	fn := filepath.Join(l.dir, id+".json")
-	fp, err := os.Open(fn)
-	if err != nil {
-		return "", "", 0, time.Time{}, err
-	}
-	defer fp.Close()
-
-	v := &metadata{}
-	if err := json.NewDecoder(fp).Decode(v); err != nil {
-		return "", "", 0, time.Time{}, err
+func (l *Local) ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	st, err := os.Stat(filepath.Join(l.dir, id))
-	if err != nil {
-		return "", "", 0, time.Time{}, err
-	}
-	return v.Filename, v.Mimetype, st.Size(), v.Timestamp, nil
+	return utils.ReadMetadata(localFS{}, l.dir, id)
 }
 
-func (l *Local) writeJSON(id string, v *metadata) error {
+func (l *Local) writeJSON(id string, v *utils.Sidecar) error {
 	fn := filepath.Join(l.dir, id+".json")
 	fp, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
@@ -103,13 +107,8 @@ func (l *Local) deleteJSON(id string) error {
 	return os.Remove(filepath.Join(l.dir, id+".json"))
 }
 
-func (l *Local) Write(id string, r io.ReadSeeker, filename string, mimetype string) (int64, error) {
-	v := &metadata{
-		Filename:  filename,
-		Mimetype:  mimetype,
-		Timestamp: time.Now().UTC(),
-	}
-	if err := l.writeJSON(id, v); err != nil {
+func (l *Local) Write(ctx context.Context, id string, r io.Reader, m *metadata.Metadata) (int64, error) {
+	if err := l.writeJSON(id, utils.NewSidecar(m)); err != nil {
 		return 0, err
 	}
 
@@ -120,13 +119,20 @@ func (l *Local) Write(id string, r io.ReadSeeker, filename string, mimetype stri
 		return 0, err
 	}
 	defer fp.Close()
-	return io.Copy(fp, r)
+	return io.Copy(fp, &utils.ContextReader{Ctx: ctx, R: r})
 }
 
-func (l *Local) Delete(id string) error {
+func (l *Local) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	err1 := l.deleteJSON(id)
 	err2 := os.Remove(filepath.Join(l.dir, id))
 	if err1 != nil && err2 != nil {
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return os.ErrNotExist
+		}
 		return errors.New(err1.Error() + " | " + err2.Error())
 	}
 	if err1 != nil {
@@ -138,7 +144,49 @@ func (l *Local) Delete(id string) error {
 	return nil
 }
 
-func (l *Local) Serve(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+func (l *Local) ListOrphans(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return utils.ListOrphans(localFS{}, l.dir)
+}
+
+func (l *Local) WriteMetadata(ctx context.Context, id string, m *metadata.Metadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fp, err := ioutil.TempFile(l.dir, "."+id+".json.")
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fp).Encode(utils.NewSidecar(m))
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), filepath.Join(l.dir, id+".json"))
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return nil
+}
+
+// Quarantine moves the files to a subdirectory of the storage directory,
+// that is ignored by List.
+func (l *Local) Quarantine(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return utils.Quarantine(localFS{}, l.dir, id)
+}
+
+func (l *Local) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
 	fn := filepath.Join(l.dir, id)
 	w.Header().Set("Content-Type", mimetype)
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -152,6 +200,6 @@ func (l *Local) Serve(w http.ResponseWriter, r *http.Request, id string, filenam
 	if !timestamp.IsZero() {
 		w.Header().Set("Last-Modified", timestamp.UTC().Format(http.TimeFormat))
 	}
-	http.ServeFile(w, r, fn)
+	http.ServeFile(w, r.WithContext(ctx), fn)
 	return nil
 }
@@ -0,0 +1,170 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+)
+
+type Memory struct {
+	data map[string]*object
+	m    sync.RWMutex
+}
+
+type object struct {
+	data     []byte
+	etag     string
+	metadata metadata.Metadata
+}
+
+func NewMemory() (*Memory, error) {
+	return &Memory{data: map[string]*object{}}, nil
+}
+
+func (m *Memory) get(id string) (*object, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	if o, ok := m.data[id]; ok {
+		return o, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *Memory) Name() string {
+	return "Memory"
+}
+
+func (m *Memory) List(ctx context.Context) ([]string, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	rv := []string{}
+	for id := range m.data {
+		rv = append(rv, id)
+	}
+	return rv, nil
+}
+
+func (m *Memory) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	o, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *Memory) ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error) {
+	o, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	rv := o.metadata
+	return &rv, nil
+}
+
+func (m *Memory) Write(ctx context.Context, id string, r io.Reader, md *metadata.Metadata) (int64, error) {
+	if _, err := m.get(id); err == nil {
+		return 0, os.ErrExist
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if _, ok := m.data[id]; ok {
+		return 0, os.ErrExist
+	}
+
+	m.data[id] = &object{
+		data: data,
+		etag: fmt.Sprintf(`"%x"`, md5.Sum(data)),
+		metadata: metadata.Metadata{
+			Filename:    md.Filename,
+			Mimetype:    md.Mimetype,
+			Size:        int64(len(data)),
+			Timestamp:   md.Timestamp,
+			Description: md.Description,
+			Tags:        append([]string{}, md.Tags...),
+		},
+	}
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Delete(ctx context.Context, id string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if _, ok := m.data[id]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.data, id)
+	return nil
+}
+
+func (m *Memory) WriteMetadata(ctx context.Context, id string, md *metadata.Metadata) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	o, ok := m.data[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	// objects are read without locking, so they must not be changed
+	m.data[id] = &object{
+		data: o.data,
+		etag: o.etag,
+		metadata: metadata.Metadata{
+			Filename:    md.Filename,
+			Mimetype:    md.Mimetype,
+			Size:        int64(len(o.data)),
+			Timestamp:   md.Timestamp,
+			Description: md.Description,
+			Tags:        append([]string{}, md.Tags...),
+		},
+	}
+	return nil
+}
+
+func (m *Memory) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	o, err := m.get(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return nil
+		}
+		return err
+	}
+
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", o.etag)
+	if filename != "" {
+		if attachment {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		} else {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		}
+	}
+	if timestamp.IsZero() {
+		timestamp = o.metadata.Timestamp
+	}
+
+	// ServeContent handles range and conditional requests
+	http.ServeContent(w, r.WithContext(ctx), filename, timestamp, bytes.NewReader(o.data))
+	return nil
+}
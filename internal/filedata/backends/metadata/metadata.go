@@ -0,0 +1,14 @@
+package metadata
+
+import (
+	"time"
+)
+
+type Metadata struct {
+	Filename    string
+	Mimetype    string
+	Size        int64
+	Timestamp   time.Time
+	Description string
+	Tags        []string
+}
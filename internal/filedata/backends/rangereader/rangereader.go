@@ -0,0 +1,121 @@
+package rangereader
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// OpenFunc opens a stream of data starting at offset, until the end of the
+// object.
+type OpenFunc func(offset int64) (io.ReadCloser, error)
+
+// ReadSeeker implements io.ReadSeeker on top of remote objects that support
+// ranged reads, so that they can be served with http.ServeContent. Data is
+// only requested when actually read, and seeking just closes the current
+// stream.
+type ReadSeeker struct {
+	open   OpenFunc
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+}
+
+func New(size int64, open OpenFunc) *ReadSeeker {
+	return &ReadSeeker{
+		open: open,
+		size: size,
+	}
+}
+
+func (r *ReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.rc == nil {
+		rc, err := r.open(r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("rangereader: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("rangereader: negative position")
+	}
+
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *ReadSeeker) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// ReaderAt implements io.ReaderAt on top of a ReadSeeker, for formats that
+// must be read out of order, like zip files. Reads are serialized, and
+// sequential reads share the same stream.
+type ReaderAt struct {
+	rs *ReadSeeker
+	m  sync.Mutex
+}
+
+func NewReaderAt(size int64, open OpenFunc) *ReaderAt {
+	return &ReaderAt{
+		rs: New(size, open),
+	}
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if off >= r.rs.size {
+		return 0, io.EOF
+	}
+
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *ReaderAt) Size() int64 {
+	return r.rs.size
+}
+
+func (r *ReaderAt) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.rs.Close()
+}
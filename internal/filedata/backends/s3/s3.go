@@ -1,15 +1,25 @@
 package s3
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/textproto"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,6 +27,15 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/utils"
+)
+
+const (
+	// bigger objects must be copied in parts
+	maxCopySize  = 5 * 1024 * 1024 * 1024
+	copyPartSize = 512 * 1024 * 1024
 )
 
 type S3Options struct {
@@ -26,18 +45,33 @@ type S3Options struct {
 	Endpoint        string
 	Region          string
 	Bucket          string
+	Prefix          string
 	PresignExpire   time.Duration
 	ProxyData       bool
 	ForcePathStyle  bool
 	SslInsecure     bool
 	SslCertificate  string
+	UploadPartSize  int64
+	UploadParallel  int
+
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	SSECustomerKey       string
+	StorageClass         string
 }
 
 type S3 struct {
 	c      *s3.S3
+	u      *s3manager.Uploader
 	bucket string
+	prefix string
 	expire time.Duration
 	proxy  bool
+
+	sse          *string
+	sseKmsKeyId  *string
+	sseCKey      *string
+	storageClass *string
 }
 
 func NewS3(options S3Options) (*S3, error) {
@@ -84,21 +118,106 @@ func NewS3(options S3Options) (*S3, error) {
 		return nil, err
 	}
 
-	return &S3{
-		c:      s3.New(sess),
+	c := s3.New(sess)
+
+	// files bigger than the part size are uploaded using the multipart api.
+	// incomplete multipart uploads are aborted by the uploader on errors.
+	u := s3manager.NewUploaderWithClient(c, func(u *s3manager.Uploader) {
+		if options.UploadPartSize > 0 {
+			u.PartSize = options.UploadPartSize
+		}
+		if options.UploadParallel > 0 {
+			u.Concurrency = options.UploadParallel
+		}
+		u.LeavePartsOnError = false
+	})
+
+	// the prefix works like a directory, so that filebin does not try to
+	// handle unrelated objects stored in the same bucket.
+	prefix := strings.TrimLeft(options.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	rv := &S3{
+		c:      c,
+		u:      u,
 		bucket: options.Bucket,
+		prefix: prefix,
 		expire: options.PresignExpire,
 		proxy:  options.ProxyData,
-	}, nil
+	}
+
+	if options.ServerSideEncryption != "" {
+		rv.sse = aws.String(options.ServerSideEncryption)
+	}
+	if options.SSEKMSKeyId != "" {
+		rv.sseKmsKeyId = aws.String(options.SSEKMSKeyId)
+	}
+	if options.SSECustomerKey != "" {
+		if rv.sse != nil {
+			return nil, errors.New("s3: SSE-C can't be used with other server-side encryption methods")
+		}
+		rv.sseCKey = aws.String(options.SSECustomerKey)
+
+		// clients can't be redirected to presigned urls, because they would
+		// need the encryption key to download the data
+		rv.proxy = true
+	}
+	if options.StorageClass != "" {
+		rv.storageClass = aws.String(options.StorageClass)
+	}
+
+	return rv, nil
+}
+
+func (s *S3) sseCAlgorithm() *string {
+	if s.sseCKey != nil {
+		return aws.String(s3.ServerSideEncryptionAes256)
+	}
+	return nil
+}
+
+// HEAD requests have no body, so the error code is not available there
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	return false
+}
+
+func (s *S3) key(id string) string {
+	return s.prefix + id
+}
+
+// pending direct uploads are stored out of the listing, until finalized
+func (s *S3) uploadKey(id string) string {
+	return s.prefix + "uploads/" + id
 }
 
-func (s *S3) keyExists(k string) bool {
+func (s *S3) headObject(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
 	conf := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(k),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
 	}
 
-	_, err := s.c.HeadObject(conf)
+	res, err := s.c.HeadObjectWithContext(ctx, conf)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *S3) keyExists(ctx context.Context, id string) bool {
+	_, err := s.headObject(ctx, s.key(id))
 	return err == nil
 }
 
@@ -106,16 +225,18 @@ func (s *S3) Name() string {
 	return "S3"
 }
 
-func (s *S3) List() ([]string, error) {
+func (s *S3) List(ctx context.Context) ([]string, error) {
 	conf := &s3.ListObjectsInput{
-		Bucket: aws.String(s.bucket),
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.prefix),
+		Delimiter: aws.String("/"),
 	}
 
 	rv := []string{}
-	if err := s.c.ListObjectsPages(conf, func(fl *s3.ListObjectsOutput, last bool) bool {
+	if err := s.c.ListObjectsPagesWithContext(ctx, conf, func(fl *s3.ListObjectsOutput, last bool) bool {
 		for _, f := range fl.Contents {
-			if k := f.Key; k != nil {
-				rv = append(rv, *k)
+			if k := f.Key; k != nil && strings.HasPrefix(*k, s.prefix) && len(*k) > len(s.prefix) {
+				rv = append(rv, (*k)[len(s.prefix):])
 			}
 		}
 		return true
@@ -126,45 +247,57 @@ func (s *S3) List() ([]string, error) {
 	return rv, nil
 }
 
-func (s *S3) Read(id string) (io.ReadCloser, error) {
+func (s *S3) Read(ctx context.Context, id string) (io.ReadCloser, error) {
 	conf := &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(id),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(id)),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
 	}
 
-	res, err := s.c.GetObject(conf)
+	res, err := s.c.GetObjectWithContext(ctx, conf)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == s3.ErrCodeNoSuchKey {
-				return nil, os.ErrNotExist
-			}
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
 		}
 		return nil, err
 	}
 	return res.Body, nil
 }
 
-func (s *S3) ReadMetadata(id string) (string, string, int64, time.Time, error) {
-	conf := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(id),
+func (s *S3) ReadRange(ctx context.Context, id string, offset int64) (io.ReadCloser, error) {
+	conf := &s3.GetObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(id)),
+		Range:                aws.String(fmt.Sprintf("bytes=%d-", offset)),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
 	}
 
-	res, err := s.c.HeadObject(conf)
+	res, err := s.c.GetObjectWithContext(ctx, conf)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == s3.ErrCodeNoSuchKey {
-				return "", "", 0, time.Time{}, os.ErrNotExist
-			}
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
 		}
-		return "", "", 0, time.Time{}, err
+		return nil, err
 	}
+	return res.Body, nil
+}
 
+func (s *S3) ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error) {
+	res, err := s.headObject(ctx, s.key(id))
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(res)
+}
+
+func parseMetadata(res *s3.HeadObjectOutput) (*metadata.Metadata, error) {
 	filename := ""
 	if v, ok := res.Metadata[textproto.CanonicalMIMEHeaderKey("filename")]; ok && v != nil {
 		filenameB, err := base64.URLEncoding.DecodeString(*v)
 		if err != nil {
-			return "", "", 0, time.Time{}, err
+			return nil, err
 		}
 		filename = string(filenameB)
 	}
@@ -182,61 +315,470 @@ func (s *S3) ReadMetadata(id string) (string, string, int64, time.Time, error) {
 	timestamp := time.Time{}
 	if v, ok := res.Metadata[textproto.CanonicalMIMEHeaderKey("timestamp")]; ok && v != nil {
 		if err := timestamp.UnmarshalText([]byte(*v)); err != nil {
-			return "", "", 0, time.Time{}, err
+			return nil, err
 		}
 	}
 
-	return filename, mimetype, size, timestamp, nil
+	description := ""
+	if v, ok := res.Metadata[textproto.CanonicalMIMEHeaderKey("description")]; ok && v != nil {
+		descriptionB, err := base64.URLEncoding.DecodeString(*v)
+		if err != nil {
+			return nil, err
+		}
+		description = string(descriptionB)
+	}
+
+	var tags []string
+	if v, ok := res.Metadata[textproto.CanonicalMIMEHeaderKey("tags")]; ok && v != nil && *v != "" {
+		tags = strings.Split(*v, ",")
+	}
+
+	return &metadata.Metadata{
+		Filename:    filename,
+		Mimetype:    mimetype,
+		Size:        size,
+		Timestamp:   timestamp,
+		Description: description,
+		Tags:        tags,
+	}, nil
 }
 
-func (s *S3) Write(id string, r io.ReadSeeker, filename string, mimetype string) (int64, error) {
-	if s.keyExists(id) {
-		return 0, os.ErrExist
+func getMetadata(m *metadata.Metadata) (map[string]*string, error) {
+	ts, err := m.Timestamp.UTC().MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]*string{
+		textproto.CanonicalMIMEHeaderKey("filename"):  aws.String(base64.URLEncoding.EncodeToString([]byte(m.Filename))),
+		textproto.CanonicalMIMEHeaderKey("mimetype"):  aws.String(m.Mimetype),
+		textproto.CanonicalMIMEHeaderKey("timestamp"): aws.String(string(ts)),
+	}
+
+	// tags are validated by filedata, and can't include commas
+	if m.Description != "" {
+		rv[textproto.CanonicalMIMEHeaderKey("description")] = aws.String(base64.URLEncoding.EncodeToString([]byte(m.Description)))
+	}
+	if len(m.Tags) > 0 {
+		rv[textproto.CanonicalMIMEHeaderKey("tags")] = aws.String(strings.Join(m.Tags, ","))
 	}
 
-	filename = base64.URLEncoding.EncodeToString([]byte(filename))
+	return rv, nil
+}
+
+func (s *S3) Write(ctx context.Context, id string, r io.Reader, m *metadata.Metadata) (int64, error) {
+	if s.keyExists(ctx, id) {
+		return 0, os.ErrExist
+	}
 
-	ts, err := time.Now().UTC().MarshalText()
+	md, err := getMetadata(m)
 	if err != nil {
 		return 0, err
 	}
 
-	conf := &s3.PutObjectInput{
-		Body:   r,
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(id),
-		Metadata: map[string]*string{
-			textproto.CanonicalMIMEHeaderKey("filename"):  aws.String(filename),
-			textproto.CanonicalMIMEHeaderKey("mimetype"):  aws.String(mimetype),
-			textproto.CanonicalMIMEHeaderKey("timestamp"): aws.String(string(ts)),
-		},
+	cr := &utils.CountingReader{R: r}
+
+	conf := &s3manager.UploadInput{
+		Body:                 cr,
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(id)),
+		Metadata:             md,
+		ServerSideEncryption: s.sse,
+		SSEKMSKeyId:          s.sseKmsKeyId,
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
+		StorageClass:         s.storageClass,
 	}
 
-	if _, err := s.c.PutObject(conf); err != nil {
+	if _, err := s.u.UploadWithContext(ctx, conf); err != nil {
 		return 0, err
 	}
 
-	return r.Seek(0, io.SeekCurrent)
+	return cr.N, nil
 }
 
-func (s *S3) Delete(id string) error {
+func (s *S3) Delete(ctx context.Context, id string) error {
 	conf := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(id),
+		Key:    aws.String(s.key(id)),
 	}
 
-	if _, err := s.c.DeleteObject(conf); err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == s3.ErrCodeNoSuchKey {
-				return os.ErrNotExist
+	if _, err := s.c.DeleteObjectWithContext(ctx, conf); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+
+	return nil
+}
+
+// PresignUpload returns a presigned POST policy, that only accepts a file
+// with the given size, and stores the metadata of the pending upload with the
+// object, so any instance can finalize it. Unlike presigned PUT requests,
+// the size is enforced by S3 before the data is stored.
+func (s *S3) PresignUpload(ctx context.Context, id string, size int64, m *metadata.Metadata) (string, map[string]string, error) {
+	if s.sseCKey != nil {
+		// the client would need the encryption key to upload the data
+		return "", nil, utils.ErrDirectUploadUnsupported
+	}
+
+	if s.keyExists(ctx, id) {
+		return "", nil, os.ErrExist
+	}
+	if _, err := s.headObject(ctx, s.uploadKey(id)); err == nil {
+		return "", nil, os.ErrExist
+	}
+
+	md, err := getMetadata(m)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fields := map[string]string{
+		"key": s.uploadKey(id),
+	}
+	for k, v := range md {
+		if v != nil && *v != "" {
+			fields["x-amz-meta-"+strings.ToLower(k)] = *v
+		}
+	}
+	if s.sse != nil {
+		fields["x-amz-server-side-encryption"] = *s.sse
+	}
+	if s.sseKmsKeyId != nil {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = *s.sseKmsKeyId
+	}
+	if s.storageClass != nil {
+		fields["x-amz-storage-class"] = *s.storageClass
+	}
+
+	creds, err := s.c.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := signPolicy(fields, s.bucket, aws.StringValue(s.c.Config.Region), creds, size, time.Now().UTC(), s.expire); err != nil {
+		return "", nil, err
+	}
+
+	// the bucket url, as used by the sdk, depending on the addressing style
+	req, _ := s.c.ListObjectsRequest(&s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+	})
+	if err := req.Build(); err != nil {
+		return "", nil, err
+	}
+	u := *req.HTTPRequest.URL
+	u.RawQuery = ""
+
+	return u.String(), fields, nil
+}
+
+// signPolicy adds a signed policy to the form fields, that requires every
+// field to have the given value, and the file to have the given size.
+func signPolicy(fields map[string]string, bucket string, region string, creds credentials.Value, size int64, now time.Time, expire time.Duration) error {
+	date := now.Format("20060102")
+	fields["x-amz-algorithm"] = "AWS4-HMAC-SHA256"
+	fields["x-amz-credential"] = fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, date, region)
+	fields["x-amz-date"] = now.Format("20060102T150405Z")
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": bucket},
+		[]interface{}{"content-length-range", size, size},
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conditions = append(conditions, map[string]string{k: fields[k]})
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(expire).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return err
+	}
+	encPolicy := base64.StdEncoding.EncodeToString(policy)
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, v := range []string{date, region, "s3", "aws4_request", encPolicy} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(v))
+		key = h.Sum(nil)
+	}
+
+	fields["policy"] = encPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(key)
+	return nil
+}
+
+// PeekUpload returns the metadata of a pending upload, including the size of
+// the uploaded data, and its first n bytes.
+func (s *S3) PeekUpload(ctx context.Context, id string, n int64) (*metadata.Metadata, []byte, error) {
+	res, err := s.headObject(ctx, s.uploadKey(id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := parseMetadata(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.Size == 0 || n <= 0 {
+		return m, []byte{}, nil
+	}
+
+	conf := &s3.GetObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.uploadKey(id)),
+		Range:                aws.String(fmt.Sprintf("bytes=0-%d", n-1)),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
+	}
+
+	res2, err := s.c.GetObjectWithContext(ctx, conf)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, err
+	}
+	defer res2.Body.Close()
+
+	head, err := ioutil.ReadAll(io.LimitReader(res2.Body, n))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, head, nil
+}
+
+// ListUploads returns the ids of the pending uploads, and when their data
+// was uploaded.
+func (s *S3) ListUploads(ctx context.Context) (map[string]time.Time, error) {
+	prefix := s.uploadKey("")
+	conf := &s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	rv := map[string]time.Time{}
+	if err := s.c.ListObjectsPagesWithContext(ctx, conf, func(fl *s3.ListObjectsOutput, last bool) bool {
+		for _, f := range fl.Contents {
+			if k := aws.StringValue(f.Key); strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+				rv[k[len(prefix):]] = aws.TimeValue(f.LastModified)
 			}
 		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (s *S3) FinalizeUpload(ctx context.Context, id string, m *metadata.Metadata) error {
+	src, err := s.headObject(ctx, s.uploadKey(id))
+	if err != nil {
+		return err
+	}
+
+	// a previous attempt may have copied the object, and failed to discard
+	// the upload
+	if dst, err := s.headObject(ctx, s.key(id)); err == nil {
+		if aws.Int64Value(dst.ContentLength) != aws.Int64Value(src.ContentLength) {
+			return os.ErrExist
+		}
+		return s.DiscardUpload(ctx, id)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	md, err := getMetadata(m)
+	if err != nil {
+		return err
+	}
+
+	if err := s.copyObject(ctx, s.uploadKey(id), s.key(id), md); err != nil {
+		return err
+	}
+
+	return s.DiscardUpload(ctx, id)
+}
+
+func (s *S3) DiscardUpload(ctx context.Context, id string) error {
+	conf := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.uploadKey(id)),
+	}
+
+	_, err := s.c.DeleteObjectWithContext(ctx, conf)
+	return err
+}
+
+func (s *S3) quarantineKey(id string) string {
+	return s.prefix + "quarantine/" + id
+}
+
+func (s *S3) copyObject(ctx context.Context, src string, dst string, md map[string]*string) error {
+	head, err := s.headObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	if size := aws.Int64Value(head.ContentLength); size > maxCopySize {
+		return s.copyObjectMultipart(ctx, src, dst, head, md)
+	}
+
+	conf := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(dst),
+		CopySource:        aws.String(url.PathEscape(s.bucket + "/" + src)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+
+		ServerSideEncryption:           s.sse,
+		SSEKMSKeyId:                    s.sseKmsKeyId,
+		SSECustomerAlgorithm:           s.sseCAlgorithm(),
+		SSECustomerKey:                 s.sseCKey,
+		CopySourceSSECustomerAlgorithm: s.sseCAlgorithm(),
+		CopySourceSSECustomerKey:       s.sseCKey,
+		StorageClass:                   s.storageClass,
+	}
+	if md != nil {
+		conf.Metadata = md
+		conf.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+	}
+
+	if _, err := s.c.CopyObjectWithContext(ctx, conf); err != nil {
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
 		return err
 	}
+	return nil
+}
 
+// copyObjectMultipart copies objects bigger than the limit of CopyObject,
+// one range at a time. Unlike CopyObject, the metadata of the source is not
+// copied by S3, and is taken from head if md is nil.
+func (s *S3) copyObjectMultipart(ctx context.Context, src string, dst string, head *s3.HeadObjectOutput, md map[string]*string) error {
+	size := aws.Int64Value(head.ContentLength)
+
+	conf := &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(dst),
+		Metadata:             md,
+		ContentType:          head.ContentType,
+		ServerSideEncryption: s.sse,
+		SSEKMSKeyId:          s.sseKmsKeyId,
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
+		StorageClass:         s.storageClass,
+	}
+
+	if md == nil {
+		conf.Metadata = head.Metadata
+		conf.CacheControl = head.CacheControl
+		conf.ContentDisposition = head.ContentDisposition
+		conf.ContentEncoding = head.ContentEncoding
+		conf.ContentLanguage = head.ContentLanguage
+	}
+
+	res, err := s.c.CreateMultipartUploadWithContext(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	parts := []*s3.CompletedPart{}
+	for i, offset := int64(1), int64(0); offset < size; i, offset = i+1, offset+copyPartSize {
+		end := offset + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		conf := &s3.UploadPartCopyInput{
+			Bucket:                         aws.String(s.bucket),
+			Key:                            aws.String(dst),
+			UploadId:                       res.UploadId,
+			PartNumber:                     aws.Int64(i),
+			CopySource:                     aws.String(url.PathEscape(s.bucket + "/" + src)),
+			CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			SSECustomerAlgorithm:           s.sseCAlgorithm(),
+			SSECustomerKey:                 s.sseCKey,
+			CopySourceSSECustomerAlgorithm: s.sseCAlgorithm(),
+			CopySourceSSECustomerKey:       s.sseCKey,
+		}
+
+		pres, err := s.c.UploadPartCopyWithContext(ctx, conf)
+		if err != nil {
+			s.abortMultipart(dst, res.UploadId)
+			if isNotFound(err) {
+				return os.ErrNotExist
+			}
+			return err
+		}
+
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       pres.CopyPartResult.ETag,
+			PartNumber: aws.Int64(i),
+		})
+	}
+
+	conf2 := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(dst),
+		UploadId: res.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: parts,
+		},
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
+	}
+
+	if _, err := s.c.CompleteMultipartUploadWithContext(ctx, conf2); err != nil {
+		s.abortMultipart(dst, res.UploadId)
+		return err
+	}
 	return nil
 }
 
+// abortMultipart discards the parts already copied. It must work even if the
+// copy failed because the context was canceled.
+func (s *S3) abortMultipart(key string, uploadId *string) {
+	conf := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadId,
+	}
+	s.c.AbortMultipartUpload(conf)
+}
+
+// WriteMetadata replaces the metadata by copying the object over itself, as
+// object metadata can't be changed in place.
+func (s *S3) WriteMetadata(ctx context.Context, id string, m *metadata.Metadata) error {
+	md, err := getMetadata(m)
+	if err != nil {
+		return err
+	}
+	return s.copyObject(ctx, s.key(id), s.key(id), md)
+}
+
+// Quarantine moves the object to a "quarantine/" prefix, that is ignored by
+// List.
+func (s *S3) Quarantine(ctx context.Context, id string) error {
+	if err := s.copyObject(ctx, s.key(id), s.quarantineKey(id), nil); err != nil {
+		return err
+	}
+	return s.Delete(ctx, id)
+}
+
 func handleError(w http.ResponseWriter, r *http.Request, err error) error {
 	if err != nil {
 		if aerr, ok := err.(awserr.RequestFailure); ok {
@@ -245,21 +787,21 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) error {
 				return nil
 			}
 		}
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == s3.ErrCodeNoSuchKey {
-				http.NotFound(w, r)
-				return nil
-			}
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return nil
 		}
 	}
 
 	return err
 }
 
-func (s *S3) serveDataHead(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+func (s *S3) serveDataHead(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
 	conf := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(id),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(id)),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
 	}
 	if v, ok := r.Header[textproto.CanonicalMIMEHeaderKey("If-Match")]; ok && len(v) > 0 {
 		conf.IfMatch = aws.String(v[0])
@@ -282,6 +824,7 @@ func (s *S3) serveDataHead(w http.ResponseWriter, r *http.Request, id string, fi
 	}
 
 	req, o := s.c.HeadObjectRequest(conf)
+	req.SetContext(ctx)
 	if err := req.Send(); err != nil {
 		return handleError(w, r, err)
 	}
@@ -328,10 +871,12 @@ func (s *S3) serveDataHead(w http.ResponseWriter, r *http.Request, id string, fi
 	return nil
 }
 
-func (s *S3) serveDataGet(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+func (s *S3) serveDataGet(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
 	conf := &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(id),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(id)),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
 	}
 	if v, ok := r.Header[textproto.CanonicalMIMEHeaderKey("If-Match")]; ok && len(v) > 0 {
 		conf.IfMatch = aws.String(v[0])
@@ -354,6 +899,7 @@ func (s *S3) serveDataGet(w http.ResponseWriter, r *http.Request, id string, fil
 	}
 
 	req, o := s.c.GetObjectRequest(conf)
+	req.SetContext(ctx)
 	if err := req.Send(); err != nil {
 		return handleError(w, r, err)
 	}
@@ -412,9 +958,11 @@ func (s *S3) serveDataGet(w http.ResponseWriter, r *http.Request, id string, fil
 
 func (s *S3) redirectDataGet(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, attachment bool) error {
 	conf := &s3.GetObjectInput{
-		Bucket:              aws.String(s.bucket),
-		Key:                 aws.String(id),
-		ResponseContentType: aws.String(mimetype),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(id)),
+		ResponseContentType:  aws.String(mimetype),
+		SSECustomerAlgorithm: s.sseCAlgorithm(),
+		SSECustomerKey:       s.sseCKey,
 	}
 	if filename != "" {
 		if attachment {
@@ -434,15 +982,15 @@ func (s *S3) redirectDataGet(w http.ResponseWriter, r *http.Request, id string,
 	return nil
 }
 
-func (s *S3) Serve(w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+func (s *S3) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
 	switch r.Method {
 	case http.MethodHead:
 		// HEAD requests are always proxied
-		return s.serveDataHead(w, r, id, filename, mimetype, timestamp, attachment)
+		return s.serveDataHead(ctx, w, r, id, filename, mimetype, timestamp, attachment)
 
 	case http.MethodGet:
 		if s.proxy {
-			return s.serveDataGet(w, r, id, filename, mimetype, timestamp, attachment)
+			return s.serveDataGet(ctx, w, r, id, filename, mimetype, timestamp, attachment)
 		}
 		return s.redirectDataGet(w, r, id, filename, mimetype, attachment)
 
@@ -0,0 +1,444 @@
+package sftp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPOptions struct {
+	Host                  string
+	Username              string
+	Password              string
+	PrivateKeyFile        string
+	PrivateKeyPassphrase  string
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+	Dir                   string
+}
+
+type SFTP struct {
+	addr string
+	conf *ssh.ClientConfig
+	dir  string
+
+	c *sftp.Client
+	m sync.Mutex
+}
+
+type sftpFS struct {
+	c *sftp.Client
+}
+
+func (sftpFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (f sftpFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return f.c.ReadDir(dir)
+}
+
+func (f sftpFS) Open(name string) (io.ReadCloser, error) {
+	return f.c.Open(name)
+}
+
+func (f sftpFS) Stat(name string) (os.FileInfo, error) {
+	return f.c.Stat(name)
+}
+
+func (f sftpFS) MkdirAll(dir string) error {
+	return f.c.MkdirAll(dir)
+}
+
+func (f sftpFS) Rename(oldpath string, newpath string) error {
+	return rename(f.c, oldpath, newpath)
+}
+
+// errorReader keeps the errors returned by the reader. sftp.File.ReadFrom
+// handles io.ErrUnexpectedEOF like io.EOF, and truncated uploads would be
+// stored as complete files.
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+func NewSFTP(options SFTPOptions) (*SFTP, error) {
+	if options.Dir == "" {
+		return nil, errors.New("sftp: storage directory not defined")
+	}
+
+	auth := []ssh.AuthMethod{}
+	if options.PrivateKeyFile != "" {
+		data, err := os.ReadFile(options.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		if options.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(options.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if options.Password != "" {
+		auth = append(auth, ssh.Password(options.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp: no authentication method defined")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if options.InsecureIgnoreHostKey {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		if options.KnownHostsFile == "" {
+			return nil, errors.New("sftp: known hosts file not defined")
+		}
+		cb, err := knownhosts.New(options.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		hostKeyCallback = cb
+	}
+
+	addr := options.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	rv := &SFTP{
+		addr: addr,
+		conf: &ssh.ClientConfig{
+			User:            options.Username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+		dir: options.Dir,
+	}
+
+	c, err := rv.client()
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := c.Stat(rv.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := c.MkdirAll(rv.dir); err != nil {
+			return nil, err
+		}
+		st, err = c.Stat(rv.dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !st.IsDir() {
+		return nil, errors.New("sftp: defined storage directory is not a directory")
+	}
+
+	return rv, nil
+}
+
+// client returns the current sftp client, connecting again if the previous
+// connection was lost.
+func (s *SFTP) client() (*sftp.Client, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.c != nil {
+		return s.c, nil
+	}
+
+	conn, err := ssh.Dial("tcp", s.addr, s.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		conn.Wait()
+
+		s.m.Lock()
+		if s.c == c {
+			s.c = nil
+		}
+		s.m.Unlock()
+
+		c.Close()
+	}()
+
+	s.c = c
+	return c, nil
+}
+
+func (s *SFTP) path(id string) string {
+	return path.Join(s.dir, id)
+}
+
+func (s *SFTP) Name() string {
+	return "SFTP"
+}
+
+func (s *SFTP) List(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.List(sftpFS{c}, s.dir)
+}
+
+func (s *SFTP) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(s.path(id))
+}
+
+func (s *SFTP) ReadMetadata(ctx context.Context, id string) (*metadata.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.ReadMetadata(sftpFS{c}, s.dir, id)
+}
+
+func (s *SFTP) Write(ctx context.Context, id string, r io.Reader, m *metadata.Metadata) (int64, error) {
+	c, err := s.client()
+	if err != nil {
+		return 0, err
+	}
+
+	// servers usually report existing files as generic failures
+	jfn := s.path(id + ".json")
+	jfp, err := c.OpenFile(jfn, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		if _, err := c.Stat(jfn); err == nil {
+			return 0, os.ErrExist
+		}
+		return 0, err
+	}
+	err = json.NewEncoder(jfp).Encode(utils.NewSidecar(m))
+	if err2 := jfp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		c.Remove(jfn)
+		return 0, err
+	}
+
+	fn := s.path(id)
+	fp, err := c.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		c.Remove(jfn)
+		if _, err := c.Stat(fn); err == nil {
+			return 0, os.ErrExist
+		}
+		return 0, err
+	}
+
+	er := &errorReader{r: &utils.ContextReader{Ctx: ctx, R: r}}
+	n, err := io.Copy(fp, er)
+	if err == nil {
+		err = er.err
+	}
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		// partial uploads would be listed as valid files
+		c.Remove(jfn)
+		c.Remove(fn)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *SFTP) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	err1 := c.Remove(s.path(id + ".json"))
+	err2 := c.Remove(s.path(id))
+	if err1 != nil && err2 != nil {
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return os.ErrNotExist
+		}
+		return errors.New(err1.Error() + " | " + err2.Error())
+	}
+	if err1 != nil {
+		return err1
+	}
+	if err2 != nil {
+		return err2
+	}
+	return nil
+}
+
+func (s *SFTP) ListOrphans(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.ListOrphans(sftpFS{c}, s.dir)
+}
+
+// rename replaces the destination file, if it exists. not every server
+// supports the posix-rename extension.
+func rename(c *sftp.Client, oldpath string, newpath string) error {
+	if err := c.PosixRename(oldpath, newpath); err == nil {
+		return nil
+	}
+	if err := c.Remove(newpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return c.Rename(oldpath, newpath)
+}
+
+func (s *SFTP) WriteMetadata(ctx context.Context, id string, m *metadata.Metadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	tfn := s.path("." + id + ".json.tmp")
+	fp, err := c.OpenFile(tfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fp).Encode(utils.NewSidecar(m))
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = rename(c, tfn, s.path(id+".json"))
+	}
+	if err != nil {
+		c.Remove(tfn)
+		return err
+	}
+	return nil
+}
+
+// Quarantine moves the files to a subdirectory of the storage directory,
+// like the local backend.
+func (s *SFTP) Quarantine(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+	return utils.Quarantine(sftpFS{c}, s.dir, id)
+}
+
+func (s *SFTP) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	fp, err := c.Open(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+
+	if timestamp.IsZero() {
+		st, err := fp.Stat()
+		if err != nil {
+			return err
+		}
+		timestamp = st.ModTime()
+	}
+
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if filename != "" {
+		if attachment {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		} else {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		}
+	}
+
+	// remote files are seekable, so ServeContent handles range and
+	// conditional requests without downloading the whole file
+	http.ServeContent(w, r.WithContext(ctx), filename, timestamp, fp)
+	return nil
+}
@@ -0,0 +1,357 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"golang.org/x/crypto/ssh"
+)
+
+type server struct {
+	addr  string
+	conns []net.Conn
+	m     sync.Mutex
+}
+
+// drop closes the connections, as if the network failed.
+func (s *server) drop() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// newServer starts an in-process sftp server, serving the local filesystem.
+func newServer(t *testing.T) *server {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "pass" {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+	}
+	conf.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	rv := &server{addr: l.Addr().String()}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			rv.m.Lock()
+			rv.conns = append(rv.conns, conn)
+			rv.m.Unlock()
+
+			go serve(conn, conf)
+		}
+	}()
+
+	return rv
+}
+
+func serve(conn net.Conn, conf *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range creqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}()
+
+		go func() {
+			defer ch.Close()
+
+			srv, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			srv.Serve()
+		}()
+	}
+}
+
+func newTestSFTP(t *testing.T) (*SFTP, *server, string) {
+	t.Helper()
+
+	srv := newServer(t)
+	dir := filepath.Join(t.TempDir(), "storage")
+	s, err := NewSFTP(SFTPOptions{
+		Host:                  srv.addr,
+		Username:              "user",
+		Password:              "pass",
+		InsecureIgnoreHostKey: true,
+		Dir:                   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if c, err := s.client(); err == nil {
+			c.Close()
+		}
+	})
+	return s, srv, dir
+}
+
+func TestNewSFTP(t *testing.T) {
+	if _, err := NewSFTP(SFTPOptions{
+		Host:                  newServer(t).addr,
+		Username:              "user",
+		Password:              "wrong",
+		InsecureIgnoreHostKey: true,
+		Dir:                   t.TempDir(),
+	}); err == nil {
+		t.Error("expected authentication error")
+	}
+
+	if _, err := NewSFTP(SFTPOptions{Host: "127.0.0.1", Password: "pass", Dir: "/tmp"}); err == nil {
+		t.Error("expected error without known hosts file")
+	}
+
+	// the storage directory is created
+	_, _, dir := newTestSFTP(t)
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		t.Errorf("storage directory not created: %v", err)
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	s, _, dir := newTestSFTP(t)
+	ctx := context.Background()
+
+	m := &metadata.Metadata{
+		Filename:    "foo.txt",
+		Mimetype:    "text/plain",
+		Timestamp:   time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Description: "bar",
+		Tags:        []string{"a", "b"},
+	}
+
+	n, err := s.Write(ctx, "foo", bytes.NewBufferString("hello world"), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 11 {
+		t.Errorf("unexpected size: %d", n)
+	}
+
+	if _, err := s.Write(ctx, "foo", bytes.NewBufferString("bola"), m); !os.IsExist(err) {
+		t.Errorf("expected ErrExist, got %v", err)
+	}
+
+	if _, err := s.Write(ctx, "bar", bytes.NewBufferString("bola"), m); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"bar", "foo"}) {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+
+	md, err := s.ReadMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Size = 11
+	if !reflect.DeepEqual(md, m) {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+
+	fp, err := s.Read(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fp)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	m.Description = "baz"
+	m.Tags = nil
+	if err := s.WriteMetadata(ctx, "foo", m); err != nil {
+		t.Fatal(err)
+	}
+	md, err = s.ReadMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md, m) {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+
+	// range requests are served without reading the whole file
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Range", "bytes=6-")
+	rec := httptest.NewRecorder()
+	if err := s.Serve(ctx, rec, req, "foo", "foo.txt", "text/plain", m.Timestamp, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "world" {
+		t.Errorf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+	if v := rec.Header().Get("Content-Disposition"); v != `inline; filename="foo.txt"` {
+		t.Errorf("unexpected content disposition: %s", v)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := s.Serve(ctx, rec, httptest.NewRequest(http.MethodGet, "/baz", nil), "baz", "", "text/plain", time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	if err := s.Delete(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "bar"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := s.ReadMetadata(ctx, "bar"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// data files without sidecars
+	if err := ioutil.WriteFile(filepath.Join(dir, "orphan"), []byte("bola"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := s.ListOrphans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orphans, []string{"orphan"}) {
+		t.Errorf("unexpected orphans: %v", orphans)
+	}
+
+	if err := s.Quarantine(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Quarantine(ctx, "foo"); !os.IsNotExist(err) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	for _, fn := range []string{"foo", "foo.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "quarantine", fn)); err != nil {
+			t.Errorf("file not quarantined: %s", err)
+		}
+	}
+
+	ids, err = s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+}
+
+// failingReader fails like the body of a truncated multipart upload.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestSFTPWriteFailure(t *testing.T) {
+	s, _, dir := newTestSFTP(t)
+
+	// partial uploads must not be listed
+	if _, err := s.Write(context.Background(), "foo", io.MultiReader(bytes.NewBufferString("hello"), failingReader{}), &metadata.Metadata{}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("unexpected files: %d", len(files))
+	}
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	s, srv, _ := newTestSFTP(t)
+	ctx := context.Background()
+
+	srv.drop()
+
+	// the connection is replaced after being lost
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.List(ctx); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,9 @@
+package utils
+
+import (
+	"errors"
+)
+
+// ErrDirectUploadUnsupported is returned by backends that implement direct
+// uploads, but can't use them with the current configuration.
+var ErrDirectUploadUnsupported = errors.New("backends: direct uploads not supported")
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// CountingReader counts the bytes read, for backends whose clients don't
+// return the size of the uploaded data.
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// ContextReader stops copying data when the context is cancelled.
+type ContextReader struct {
+	Ctx context.Context
+	R   io.Reader
+}
+
+func (c *ContextReader) Read(p []byte) (int, error) {
+	if err := c.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.R.Read(p)
+}
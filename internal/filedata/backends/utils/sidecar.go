@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+)
+
+// Sidecar is the metadata stored in a json file next to the data, by the
+// backends that store files in a directory. The same layout is used by every
+// such backend, so that storage directories can be moved around.
+type Sidecar struct {
+	Filename    string    `json:"filename"`
+	Mimetype    string    `json:"mimetype"`
+	Timestamp   time.Time `json:"timestamp"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+func NewSidecar(m *metadata.Metadata) *Sidecar {
+	return &Sidecar{
+		Filename:    m.Filename,
+		Mimetype:    m.Mimetype,
+		Timestamp:   m.Timestamp,
+		Description: m.Description,
+		Tags:        m.Tags,
+	}
+}
+
+func (s *Sidecar) Metadata(size int64) *metadata.Metadata {
+	return &metadata.Metadata{
+		Filename:    s.Filename,
+		Mimetype:    s.Mimetype,
+		Size:        size,
+		Timestamp:   s.Timestamp,
+		Description: s.Description,
+		Tags:        s.Tags,
+	}
+}
+
+// FS is the subset of filesystem operations used to handle storage
+// directories, implemented by the local and sftp backends.
+type FS interface {
+	Join(elem ...string) string
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(dir string) error
+
+	// Rename must replace newpath, if it exists.
+	Rename(oldpath string, newpath string) error
+}
+
+func sidecarId(fn string) (string, bool) {
+	if path.Ext(fn) != ".json" {
+		return "", false
+	}
+	return fn[:len(fn)-5], true
+}
+
+// List returns the ids of the files with sidecars in the storage directory.
+func List(fs FS, dir string) ([]string, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if id, ok := sidecarId(file.Name()); ok {
+			rv = append(rv, id)
+		}
+	}
+	return rv, nil
+}
+
+// ListOrphans returns the data files without sidecars in the storage
+// directory.
+func ListOrphans(fs FS, dir string) ([]string, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecars := map[string]bool{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if id, ok := sidecarId(file.Name()); ok {
+			sidecars[id] = true
+		}
+	}
+
+	// hidden files are temporary files created by WriteMetadata
+	rv := []string{}
+	for _, file := range files {
+		if fn := file.Name(); !file.IsDir() && !strings.HasPrefix(fn, ".") && path.Ext(fn) != ".json" && !sidecars[fn] {
+			rv = append(rv, fn)
+		}
+	}
+	return rv, nil
+}
+
+func ReadMetadata(fs FS, dir string, id string) (*metadata.Metadata, error) {
+	fp, err := fs.Open(fs.Join(dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	v := &Sidecar{}
+	if err := json.NewDecoder(fp).Decode(v); err != nil {
+		return nil, err
+	}
+
+	st, err := fs.Stat(fs.Join(dir, id))
+	if err != nil {
+		return nil, err
+	}
+	return v.Metadata(st.Size()), nil
+}
+
+// Quarantine moves the files to a subdirectory of the storage directory,
+// that is ignored by List.
+func Quarantine(fs FS, dir string, id string) error {
+	qdir := fs.Join(dir, "quarantine")
+	if err := fs.MkdirAll(qdir); err != nil {
+		return err
+	}
+
+	found := false
+	for _, fn := range []string{id + ".json", id} {
+		if _, err := fs.Stat(fs.Join(dir, fn)); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := fs.Rename(fs.Join(dir, fn), fs.Join(qdir, fn)); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/utils"
+	"github.com/rafaelmartins/filebin/internal/id"
+	"github.com/rafaelmartins/filebin/internal/mime"
+	"github.com/rafaelmartins/filebin/internal/settings"
+)
+
+const (
+	// pending uploads are stored by the backend until finalized. if the
+	// client does not finalize the upload in this period, the data is
+	// discarded and it must start over.
+	pendingTTL = 24 * time.Hour
+
+	// how often the backend is checked for pending uploads that expired
+	pendingCleanupInterval = time.Hour
+)
+
+var (
+	ErrDirectUploadUnsupported = errors.New("filedata: direct uploads not supported by backend")
+	ErrDirectUploadInvalid     = errors.New("filedata: invalid direct upload")
+)
+
+// DirectUpload describes a POST request that uploads a file straight to the
+// backend. The form fields must be sent before the file, in a field named
+// "file".
+type DirectUpload struct {
+	Id     string            `json:"id"`
+	Method string            `json:"method"`
+	Url    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+func getDirectUploader() (backends.DirectUploader, error) {
+	s, err := settings.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := backends.Unwrap(s.Backend).(backends.DirectUploader)
+	if !ok {
+		return nil, ErrDirectUploadUnsupported
+	}
+	return d, nil
+}
+
+// cleanupUploads discards the pending uploads that were not finalized in
+// time. The backend is shared by every instance, so they may all try to
+// discard the same uploads.
+func cleanupUploads(ctx context.Context, d backends.DirectUploader) {
+	s, err := settings.Get()
+	if err != nil {
+		log.Printf("error: %s", err)
+		return
+	}
+
+	lctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+	uploads, err := d.ListUploads(lctx)
+	cancel()
+	if err != nil {
+		log.Printf("error: filedata: pending uploads: %s", err)
+		return
+	}
+
+	for fid, t := range uploads {
+		if time.Since(t) < pendingTTL {
+			continue
+		}
+
+		dctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+		if err := d.DiscardUpload(dctx, fid); err != nil && !os.IsNotExist(err) {
+			log.Printf("error: filedata: pending upload: %s: %s", fid, err)
+		}
+		cancel()
+	}
+}
+
+func cleanupUploadsLoop(ctx context.Context, d backends.DirectUploader) {
+	t := time.NewTicker(pendingCleanupInterval)
+	defer t.Stop()
+
+	for {
+		cleanupUploads(ctx, d)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func NewDirectUpload(ctx context.Context, filename string, size int64, description string, tags []string) (*DirectUpload, error) {
+	s, err := settings.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := getDirectUploader()
+	if err != nil {
+		return nil, err
+	}
+
+	if filename == "" {
+		return nil, fmt.Errorf("%w: missing filename", ErrDirectUploadInvalid)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: invalid file size", ErrDirectUploadInvalid)
+	}
+	if size > int64(s.UploadMaxSizeMb)*1024*1024 {
+		return nil, fmt.Errorf("%w: file bigger than allowed size", ErrDirectUploadInvalid)
+	}
+	if err := validateDescription(description); err != nil {
+		return nil, err
+	}
+
+	for {
+		fid, err := id.Generate(s.IdLength)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := NewFromId(ctx, fid); err == nil {
+			continue
+		}
+
+		// the mimetype is only detected after the upload
+		m := &metadata.Metadata{
+			Filename:    filename,
+			Timestamp:   time.Now().UTC(),
+			Description: description,
+			Tags:        tags,
+		}
+
+		pctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+		requrl, fields, err := d.PresignUpload(pctx, fid, size, m)
+		cancel()
+		if err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			if err == utils.ErrDirectUploadUnsupported {
+				return nil, ErrDirectUploadUnsupported
+			}
+			return nil, err
+		}
+
+		return &DirectUpload{
+			Id:     fid,
+			Method: http.MethodPost,
+			Url:    requrl,
+			Fields: fields,
+		}, nil
+	}
+}
+
+// FinalizeDirectUpload registers a file uploaded using a DirectUpload. The
+// upload may have been started by another instance.
+func FinalizeDirectUpload(ctx context.Context, id string) (*FileData, error) {
+	s, err := settings.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := getDirectUploader()
+	if err != nil {
+		return nil, err
+	}
+
+	// finalizing copies the whole object, so it is handled as a write
+	wctx, cancel := withTimeout(ctx, s.BackendTimeoutWrite)
+	defer cancel()
+
+	p, head, err := d.PeekUpload(wctx, id, 512)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	// the upload may have happened right before the policy expired, but
+	// not finalized since then
+	if time.Since(p.Timestamp) > pendingTTL {
+		d.DiscardUpload(wctx, id)
+		return nil, ErrNotFound
+	}
+
+	// the size is enforced by the upload policy, but the limit may have
+	// been changed since then
+	if p.Size > int64(s.UploadMaxSizeMb)*1024*1024 {
+		d.DiscardUpload(wctx, id)
+		return nil, fmt.Errorf("%w: file bigger than allowed size", ErrDirectUploadInvalid)
+	}
+
+	m, err := mime.DetectFromFilename(bytes.NewReader(head), p.Filename)
+	if err != nil {
+		d.DiscardUpload(wctx, id)
+		return nil, err
+	}
+
+	md := &metadata.Metadata{
+		Filename:    p.Filename,
+		Mimetype:    m,
+		Timestamp:   time.Now().UTC(),
+		Description: p.Description,
+		Tags:        p.Tags,
+	}
+	if err := d.FinalizeUpload(wctx, id, md); err != nil {
+		return nil, err
+	}
+
+	return newfd(ctx, id, false)
+}
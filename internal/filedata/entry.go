@@ -0,0 +1,111 @@
+package filedata
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// entry holds the data of a file extracted from an archive. such files are
+// not stored in the backend, but can be rendered like any other file.
+type entry struct {
+	path string
+	data []byte
+}
+
+// NewEntry creates a file from a member of an archive, so that it can be
+// rendered. Entries are not registered, and their id is the id of the
+// archive.
+func NewEntry(archive *FileData, p string, data []byte, mimetype string, timestamp time.Time) *FileData {
+	if timestamp.IsZero() {
+		timestamp = archive.Timestamp
+	}
+	return &FileData{
+		id:        archive.id,
+		Filename:  path.Base(p),
+		Mimetype:  mimetype,
+		Size:      int64(len(data)),
+		Timestamp: timestamp,
+		entry: &entry{
+			path: p,
+			data: data,
+		},
+	}
+}
+
+// IsEntry checks if the file was extracted from an archive.
+func (f *FileData) IsEntry() bool {
+	return f.entry != nil
+}
+
+// Path returns the path of the file page in the server. The other paths must
+// be used by renderers to link to the variants of the file, because entries
+// use different urls.
+func (f *FileData) Path() string {
+	if f.entry == nil {
+		return "/" + f.id
+	}
+
+	parts := strings.Split(f.entry.path, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return "/" + f.id + "/entry/" + strings.Join(parts, "/")
+}
+
+func (f *FileData) RawPath() string {
+	if f.entry == nil {
+		return "/" + f.id + "/raw"
+	}
+	return f.Path() + "?view=raw"
+}
+
+func (f *FileData) DownloadPath() string {
+	if f.entry == nil {
+		return "/" + f.id + "/download"
+	}
+	return f.Path() + "?view=download"
+}
+
+func (f *FileData) TextPath() string {
+	if f.entry == nil {
+		return "/" + f.id + ".txt"
+	}
+	return f.Path() + "?view=text"
+}
+
+func (e *entry) read() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(e.data))
+}
+
+type nopReadAtCloser struct {
+	*bytes.Reader
+}
+
+func (nopReadAtCloser) Close() error {
+	return nil
+}
+
+func (e *entry) readAt() ReadAtCloser {
+	return nopReadAtCloser{bytes.NewReader(e.data)}
+}
+
+func (e *entry) serve(w http.ResponseWriter, r *http.Request, filename string, mimetype string, timestamp time.Time, attachment bool) {
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if filename != "" {
+		if attachment {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		} else {
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		}
+	}
+
+	// ServeContent handles range and conditional requests
+	http.ServeContent(w, r, filename, timestamp, bytes.NewReader(e.data))
+}
@@ -0,0 +1,155 @@
+package filedata
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventUpload EventType = "upload"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+	EventExpire EventType = "expire"
+)
+
+// Event notifies changes to the registry. Uploads include files found in the
+// backend that were uploaded by other instances, deletions include files
+// deleted by other instances, and files that disappeared from the backend
+// otherwise, e.g. removed by lifecycle rules, expire.
+type Event struct {
+	Seq  uint64
+	Type EventType
+	File *FileData
+	Time time.Time
+
+	// Found is true for uploads and deletions that were not handled by this
+	// instance.
+	Found bool
+}
+
+// Removed checks if the file was removed from the registry.
+func (e *Event) Removed() bool {
+	return e.Type == EventDelete || e.Type == EventExpire
+}
+
+const (
+	// events kept for listeners that reconnect, e.g. event stream clients
+	eventHistory = 256
+)
+
+var (
+	listeners = &eventListeners{}
+	bcast     = &broadcaster{subs: map[chan *Event]bool{}}
+)
+
+type eventListeners struct {
+	data []func(*Event)
+	m    sync.RWMutex
+}
+
+// Subscribe registers a function to be called for every event. It is called
+// synchronously, so it must not block.
+func Subscribe(f func(*Event)) {
+	listeners.m.Lock()
+	defer listeners.m.Unlock()
+
+	listeners.data = append(listeners.data, f)
+}
+
+type broadcaster struct {
+	seq     uint64
+	history []*Event
+	subs    map[chan *Event]bool
+	closed  bool
+	m       sync.Mutex
+}
+
+// Listen returns a channel that receives every event emitted after the event
+// with the given sequence number, as long as it is still available in the
+// history, or just the new events if zero. The channel is closed when the
+// returned function is called, or if the listener can't keep up with the
+// events, or by CloseListeners.
+func Listen(since uint64) (<-chan *Event, func()) {
+	bcast.m.Lock()
+	defer bcast.m.Unlock()
+
+	ch := make(chan *Event, 2*eventHistory)
+	if bcast.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if since > 0 && since <= bcast.seq {
+		for _, e := range bcast.history {
+			if e.Seq > since {
+				ch <- e
+			}
+		}
+	}
+	bcast.subs[ch] = true
+
+	return ch, func() {
+		bcast.m.Lock()
+		defer bcast.m.Unlock()
+
+		if bcast.subs[ch] {
+			delete(bcast.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// CloseListeners closes the channels of every listener, including the ones
+// created afterwards, so long-lived requests, like event streams, don't hold
+// the server shutdown.
+func CloseListeners() {
+	bcast.m.Lock()
+	defer bcast.m.Unlock()
+
+	bcast.closed = true
+	for ch := range bcast.subs {
+		delete(bcast.subs, ch)
+		close(ch)
+	}
+}
+
+func (b *broadcaster) publish(e *Event) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistory {
+		b.history = b.history[len(b.history)-eventHistory:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// uploads must not wait for slow listeners
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func emit(t EventType, fd *FileData, found bool) {
+	e := &Event{
+		Type:  t,
+		File:  fd,
+		Time:  time.Now().UTC(),
+		Found: found,
+	}
+	bcast.publish(e)
+
+	listeners.m.RLock()
+	defer listeners.m.RUnlock()
+
+	for _, f := range listeners.data {
+		f(e)
+	}
+}
@@ -1,9 +1,13 @@
 package filedata
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -13,29 +17,52 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/rangereader"
 	"github.com/rafaelmartins/filebin/internal/id"
 	"github.com/rafaelmartins/filebin/internal/mime"
 	"github.com/rafaelmartins/filebin/internal/settings"
 )
 
+const (
+	// ids not found in the backend are not looked up again for a while, so
+	// that requests for random ids don't reach the backend every time.
+	missingTTL = 30 * time.Second
+	missingMax = 10000
+
+	// form values are way smaller than files, that are not read to memory
+	maxFormValueSize = 64 * 1024
+)
+
 var (
 	ErrNotFound = errors.New("filedata: not found")
 
-	reg = &registry{data: map[string]*FileData{}}
+	reg = &registry{
+		data:     map[string]*FileData{},
+		missing:  map[string]time.Time{},
+		deleting: map[string]bool{},
+	}
 )
 
 type registry struct {
 	data      map[string]*FileData
 	dataslice []*FileData
+	missing   map[string]time.Time
+	deleting  map[string]bool
 	m         sync.RWMutex
 }
 
 type FileData struct {
-	id        string
-	Filename  string    `json:"filename"`
-	Mimetype  string    `json:"mimetype"`
-	Size      int64     `json:"size"`
-	Timestamp time.Time `json:"timestamp"`
+	id          string
+	Filename    string    `json:"filename"`
+	Mimetype    string    `json:"mimetype"`
+	Size        int64     `json:"size"`
+	Timestamp   time.Time `json:"timestamp"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+
+	entry *entry
 }
 
 type byDate struct {
@@ -54,13 +81,184 @@ func (b *byDate) Less(i int, j int) bool {
 	return b.data[i].Timestamp.UnixNano() < b.data[j].Timestamp.UnixNano()
 }
 
-func newfd(id string) (*FileData, error) {
+type readCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *readCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// ReadAtCloser is returned by OpenReaderAt.
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type readAtCloser struct {
+	ReadAtCloser
+	cancel context.CancelFunc
+}
+
+func (r *readAtCloser) Close() error {
+	defer r.cancel()
+	return r.ReadAtCloser.Close()
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// add registers the file, unless another request registered it first. The
+// registered file is returned, or nil if the file is being deleted.
+func (r *registry) add(fd *FileData, found bool) *FileData {
+	r.m.Lock()
+
+	if v, ok := r.data[fd.id]; ok {
+		r.m.Unlock()
+		return v
+	}
+	if r.deleting[fd.id] {
+		r.m.Unlock()
+		return nil
+	}
+	delete(r.missing, fd.id)
+	r.data[fd.id] = fd
+	r.insert(fd)
+
+	r.m.Unlock()
+
+	emit(EventUpload, fd, found)
+	return fd
+}
+
+// insert must be called with the lock held.
+func (r *registry) insert(fd *FileData) {
+	// new uploads usually end up in the end of the list, but files found in
+	// the backend later may be older than that.
+	i := sort.Search(len(r.dataslice), func(i int) bool {
+		return r.dataslice[i].Timestamp.After(fd.Timestamp)
+	})
+	r.dataslice = append(r.dataslice, nil)
+	copy(r.dataslice[i+1:], r.dataslice[i:])
+	r.dataslice[i] = fd
+}
+
+// replace registers a new version of a file, if the file is still
+// registered. listeners get an update event, instead of delete and upload
+// events, so that data related to the file id is kept.
+func (r *registry) replace(fd *FileData) bool {
+	r.m.Lock()
+
+	old, ok := r.data[fd.id]
+	if !ok {
+		r.m.Unlock()
+		return false
+	}
+	r.data[fd.id] = fd
+
+	n := make([]*FileData, 0, len(r.dataslice))
+	for _, v := range r.dataslice {
+		if v != old {
+			n = append(n, v)
+		}
+	}
+	r.dataslice = n
+	r.insert(fd)
+
+	r.m.Unlock()
+
+	emit(EventUpdate, fd, false)
+	return true
+}
+
+func (r *registry) remove(fd *FileData, t EventType, found bool) {
+	r.m.Lock()
+
+	if v, ok := r.data[fd.id]; !ok || v != fd {
+		r.m.Unlock()
+		return
+	}
+	delete(r.data, fd.id)
+
+	n := []*FileData{}
+	for _, v := range r.dataslice {
+		if v != fd {
+			n = append(n, v)
+		}
+	}
+	r.dataslice = n
+
+	r.m.Unlock()
+
+	emit(t, fd, found)
+}
+
+// miss records that the id was not found in the backend.
+func (r *registry) miss(id string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.missing) >= missingMax {
+		now := time.Now()
+		for k, v := range r.missing {
+			if now.Sub(v) >= missingTTL {
+				delete(r.missing, k)
+			}
+		}
+	}
+
+	// when the cache is full, unknown ids are only found by Reconcile
+	if len(r.missing) < missingMax {
+		r.missing[id] = time.Now()
+	}
+}
+
+// lookup checks if an unregistered id may be looked up in the backend.
+func (r *registry) lookup(id string) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if r.deleting[id] || len(r.missing) >= missingMax {
+		return false
+	}
+	t, ok := r.missing[id]
+	return !ok || time.Since(t) >= missingTTL
+}
+
+func (r *registry) setDeleting(id string, deleting bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if deleting {
+		r.deleting[id] = true
+	} else {
+		delete(r.deleting, id)
+	}
+}
+
+func (r *registry) isDeleting(id string) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return r.deleting[id]
+}
+
+func load(ctx context.Context, id string) (*FileData, error) {
 	s, err := settings.Get()
 	if err != nil {
 		return nil, err
 	}
 
-	filename, mimetype, size, timestamp, err := s.Backend.ReadMetadata(id)
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+	defer cancel()
+
+	m, err := s.Backend.ReadMetadata(ctx, id)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, ErrNotFound
@@ -68,69 +266,226 @@ func newfd(id string) (*FileData, error) {
 		return nil, err
 	}
 
-	fd := &FileData{
-		id:        id,
-		Filename:  filename,
-		Mimetype:  mimetype,
-		Size:      size,
-		Timestamp: timestamp,
+	return &FileData{
+		id:          id,
+		Filename:    m.Filename,
+		Mimetype:    m.Mimetype,
+		Size:        m.Size,
+		Timestamp:   m.Timestamp,
+		Description: m.Description,
+		Tags:        m.Tags,
+	}, nil
+}
+
+func newfd(ctx context.Context, id string, found bool) (*FileData, error) {
+	fd, err := load(ctx, id)
+	if err != nil {
+		return nil, err
 	}
 
-	reg.m.Lock()
-	reg.data[fd.id] = fd
-	reg.dataslice = append(reg.dataslice, fd)
-	reg.m.Unlock()
+	if rv := reg.add(fd, found); rv != nil {
+		return rv, nil
+	}
+	return nil, ErrNotFound
+}
+
+// list returns the ids of the files in the backend, and of the files deleted
+// recently, that have tombstones.
+func list(ctx context.Context) ([]string, map[string]bool, error) {
+	s, err := settings.Get()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return fd, nil
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+	defer cancel()
+
+	ids, err := s.Backend.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the backend also stores files derived from the uploads, e.g.
+	// thumbnails, using ids that can't be generated for uploads.
+	rv := make([]string, 0, len(ids))
+	deleted := map[string]bool{}
+	for _, v := range ids {
+		if id.Valid(v) {
+			rv = append(rv, v)
+		} else if fid, ok := parseTombstoneId(v); ok {
+			deleted[fid] = true
+		}
+	}
+	return rv, deleted, nil
 }
 
-func Init() error {
+func Init(ctx context.Context) error {
 	s, err := settings.Get()
 	if err != nil {
 		return err
 	}
 
-	ids, err := s.Backend.List()
+	ids, _, err := list(ctx)
 	if err != nil {
 		return err
 	}
 
+	// broken files must not prevent filebin from starting. they can be
+	// found and fixed with `filebin fsck`.
+	fds := []*FileData{}
 	for _, id := range ids {
-		if _, err := newfd(id); err != nil {
-			return err
+		fd, err := load(ctx, id)
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			log.Printf("error: filedata: skipping %s: %s", id, err)
+			continue
 		}
+		fds = append(fds, fd)
 	}
 
 	reg.m.Lock()
-	defer reg.m.Unlock()
-
+	for _, fd := range fds {
+		if _, ok := reg.data[fd.id]; !ok {
+			reg.data[fd.id] = fd
+			reg.dataslice = append(reg.dataslice, fd)
+		}
+	}
 	sort.Sort(&byDate{reg.dataslice})
+	reg.m.Unlock()
+
+	Subscribe(cleanupThumbnail)
+
+	if s.ReconcileInterval > 0 {
+		go reconcileLoop(ctx, s.ReconcileInterval)
+	}
+
+	if d, ok := backends.Unwrap(s.Backend).(backends.DirectUploader); ok {
+		go cleanupUploadsLoop(ctx, d)
+	}
 
 	return nil
 }
 
-func processFile(fh *multipart.FileHeader) (*FileData, error) {
-	s, err := settings.Get()
+// Reconcile synchronizes the registry with the files available in the
+// backend, that may have been changed by other filebin instances.
+func Reconcile(ctx context.Context) error {
+	// files uploaded while listing the backend must not be dropped, so only
+	// the files registered before listing are considered for removal.
+	reg.m.RLock()
+	known := make(map[string]*FileData, len(reg.data))
+	for k, v := range reg.data {
+		known[k] = v
+	}
+	reg.m.RUnlock()
+
+	ids, deleted, err := list(ctx)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	found := make(map[string]bool, len(ids))
+	errl := []string{}
+	for _, id := range ids {
+		found[id] = true
+		if _, ok := known[id]; ok {
+			continue
+		}
+
+		fd, err := load(ctx, id)
+		if err != nil {
+			if err != ErrNotFound {
+				errl = append(errl, fmt.Sprintf("%s: %s", id, err))
+			}
+			continue
+		}
+		reg.add(fd, true)
+	}
+
+	for id, fd := range known {
+		// files being deleted by this instance get a delete event instead
+		if found[id] || reg.isDeleting(id) {
+			continue
+		}
+
+		// files deleted by other instances leave tombstones, and are not
+		// reported as expired
+		if deleted[id] {
+			reg.remove(fd, EventDelete, true)
+		} else {
+			reg.remove(fd, EventExpire, false)
+		}
+	}
+
+	tombs.cleanup(ctx, deleted)
+
+	if len(errl) > 0 {
+		return fmt.Errorf("filedata: reconcile: %s", strings.Join(errl, " | "))
 	}
+	return nil
+}
 
-	f, err := fh.Open()
+// Refresh reads the metadata of a file again, after it was changed in the
+// backend, e.g. by `filebin fsck`. Files not registered yet are registered.
+func Refresh(ctx context.Context, id string) error {
+	fd, err := load(ctx, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
 
-	if fh.Size > int64(s.UploadMaxSizeMb)*1024*1024 {
-		return nil, errors.New("filedata: uploaded file bigger than allowed size")
+	if !reg.replace(fd) {
+		reg.add(fd, true)
+	}
+	return nil
+}
+
+func reconcileLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := Reconcile(ctx); err != nil {
+				log.Printf("error: %s", err)
+			}
+		}
 	}
+}
 
-	m, err := mime.Detect(f, fh)
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// processFile streams an uploaded file to the backend. Only the start of the
+// file is kept in memory, to detect the mime type.
+func processFile(ctx context.Context, p *multipart.Part, description string, tags []string) (*FileData, error) {
+	s, err := settings.Get()
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
+	maxSize := int64(s.UploadMaxSizeMb) * 1024 * 1024
+
+	head := make([]byte, 512)
+	hn, err := io.ReadFull(p, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:hn]
+
+	m, err := mime.Detect(bytes.NewReader(head), p)
+	if err != nil {
 		return nil, err
 	}
 
@@ -146,81 +501,173 @@ func processFile(fh *multipart.FileHeader) (*FileData, error) {
 			return nil, err
 		}
 
-		n, err = s.Backend.Write(fid, f, fh.Filename, m)
-		if err != nil {
-			if !os.IsExist(err) {
-				return nil, err
-			}
-			if _, err := f.Seek(0, io.SeekStart); err != nil {
-				return nil, err
-			}
-		} else {
+		body := &countingReader{r: p}
+
+		wctx, cancel := withTimeout(ctx, s.BackendTimeoutWrite)
+		n, err = s.Backend.Write(wctx, fid, io.LimitReader(io.MultiReader(bytes.NewReader(head), body), maxSize+1), &metadata.Metadata{
+			Filename:    p.FileName(),
+			Mimetype:    m,
+			Timestamp:   time.Now().UTC(),
+			Description: description,
+			Tags:        tags,
+		})
+		cancel()
+		if err == nil {
 			break
 		}
-	}
 
-	if n != fh.Size {
-		s.Backend.Delete(fid)
-		if n < fh.Size {
-			return nil, errors.New("filedata: write: unexpected eof")
+		// the file belongs to someone else, and can only be written with
+		// another id if nothing was consumed from the request yet
+		if os.IsExist(err) {
+			if body.n == 0 {
+				continue
+			}
+			return nil, err
 		}
-		return nil, errors.New("filedata: write: mismatched file size")
+
+		// e.g. the client disconnected in the middle of the upload, that
+		// also cancels the request context
+		dctx, cancel := withTimeout(context.WithoutCancel(ctx), s.BackendTimeoutMetadata)
+		s.Backend.Delete(dctx, fid)
+		cancel()
+		return nil, err
+	}
+
+	if n > maxSize {
+		dctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+		s.Backend.Delete(dctx, fid)
+		cancel()
+		return nil, errors.New("filedata: uploaded file bigger than allowed size")
 	}
 
-	return newfd(fid)
+	return newfd(ctx, fid, false)
 }
 
+func readFormValue(p *multipart.Part) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(p, maxFormValueSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxFormValueSize {
+		return "", fmt.Errorf("%w: form value too long: %s", ErrInvalidMetadata, p.FormName())
+	}
+	return string(data), nil
+}
+
+// NewFromRequest streams the files uploaded in a multipart request to the
+// backend, while reading the request. The description and tags are shared by
+// all the files, and must be sent before them.
 func NewFromRequest(r *http.Request) ([]*FileData, error) {
 	if r == nil {
 		return nil, errors.New("filedata: nil request")
 	}
 
-	if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil {
+	mr, err := r.MultipartReader()
+	if err != nil {
 		return nil, err
 	}
 
-	if r.MultipartForm == nil || r.MultipartForm.File == nil {
-		return nil, errors.New("filedata: no files")
-	}
-	defer r.MultipartForm.RemoveAll()
-
-	fhs := r.MultipartForm.File["file"]
-	if len(fhs) == 0 {
-		return nil, errors.New("filedata: no files")
-	}
+	var (
+		description  string
+		descriptions []string
+		values       []string
+		tags         []string
+		fds          = []*FileData{}
+		errl         = []string{}
+	)
 
-	fds := []*FileData{}
-	errl := []string{}
-	for i, fh := range fhs {
-		fd, err := processFile(fh)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			fds = append(fds, nil)
-			errl = append(errl, fmt.Sprintf("%d: %s", i, err.Error()))
-			continue
+			if len(fds) == 0 {
+				return nil, err
+			}
+			errl = append(errl, err.Error())
+			break
 		}
-		fds = append(fds, fd)
-	}
 
-	var err error
-	if len(errl) > 0 {
-		err = errors.New(strings.Join(errl, " | "))
+		switch name := p.FormName(); {
+		case name == "file" && p.FileName() != "":
+			if len(fds) == 0 {
+				if len(descriptions) > 0 {
+					description = strings.TrimSpace(descriptions[0])
+				}
+				if err := validateDescription(description); err != nil {
+					return nil, err
+				}
+				tags, err = ParseTags(values)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			fd, err := processFile(r.Context(), p, description, tags)
+			if err != nil {
+				fds = append(fds, nil)
+				errl = append(errl, fmt.Sprintf("%d: %s", len(fds)-1, err.Error()))
+				break
+			}
+			fds = append(fds, fd)
+
+		case name == "description" || name == "tags":
+			if len(fds) > 0 {
+				// the files were uploaded without the metadata
+				for _, fd := range fds {
+					if fd != nil {
+						if err := Delete(r.Context(), fd.GetId()); err != nil {
+							log.Printf("error: %s", err)
+						}
+					}
+				}
+				return nil, fmt.Errorf("%w: %s must be sent before the files", ErrInvalidMetadata, name)
+			}
+
+			v, err := readFormValue(p)
+			if err != nil {
+				return nil, err
+			}
+			if name == "tags" {
+				values = append(values, v)
+			} else {
+				descriptions = append(descriptions, v)
+			}
+		}
+		p.Close()
 	}
 
 	if len(fds) == 0 {
-		return nil, err
+		return nil, errors.New("filedata: no files")
 	}
-	return fds, err
+
+	if len(errl) > 0 {
+		return fds, errors.New(strings.Join(errl, " | "))
+	}
+	return fds, nil
 }
 
-func NewFromId(id string) (*FileData, error) {
+func NewFromId(ctx context.Context, fid string) (*FileData, error) {
 	reg.m.RLock()
-	defer reg.m.RUnlock()
+	fd, ok := reg.data[fid]
+	reg.m.RUnlock()
 
-	if fd, ok := reg.data[id]; ok {
+	if ok {
 		return fd, nil
 	}
 
-	return nil, ErrNotFound
+	// the file may have been uploaded by another instance sharing the
+	// backend, and not reconciled yet.
+	if !id.Valid(fid) || !reg.lookup(fid) {
+		return nil, ErrNotFound
+	}
+
+	fd, err := newfd(ctx, fid, true)
+	if err == ErrNotFound {
+		reg.miss(fid)
+	}
+	return fd, err
 }
 
 func ForEach(f func(*FileData)) {
@@ -232,31 +679,66 @@ func ForEach(f func(*FileData)) {
 	}
 }
 
-func Delete(id string) error {
+func Delete(ctx context.Context, id string) error {
 	s, err := settings.Get()
 	if err != nil {
 		return err
 	}
 
-	fd, err := NewFromId(id)
+	fd, err := NewFromId(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	reg.m.Lock()
-	defer reg.m.Unlock()
-
-	delete(reg.data, fd.id)
+	return Remove(ctx, fd.id, func() error {
+		ctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+		defer cancel()
 
-	n := []*FileData{}
-	for _, v := range reg.dataslice {
-		if v.id != id {
-			n = append(n, v)
+		if err := s.Backend.Delete(ctx, fd.id); err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		return nil
+	})
+}
+
+// Remove calls remove to take a file out of the backend, e.g. deleting or
+// quarantining it, and then unregisters it, notifying the deletion. The file
+// does not need to be registered, to allow removing broken files.
+func Remove(ctx context.Context, fid string, remove func() error) error {
+	// the file is removed from the backend first, and must not be registered
+	// again by concurrent lookups meanwhile
+	reg.setDeleting(fid, true)
+	defer reg.setDeleting(fid, false)
+
+	valid := id.Valid(fid)
+	if valid {
+		writeTombstone(ctx, fid)
+	}
+
+	if err := remove(); err != nil {
+		return err
 	}
-	reg.dataslice = n
 
-	return s.Backend.Delete(fd.id)
+	reg.m.RLock()
+	fd, ok := reg.data[fid]
+	reg.m.RUnlock()
+
+	if ok {
+		reg.remove(fd, EventDelete, false)
+	} else if valid {
+		deleteThumbnail(ctx, fid)
+	}
+	reg.miss(fid)
+	return nil
+}
+
+// Registered checks if the file is still available, i.e. it was not deleted.
+func (f *FileData) Registered() bool {
+	reg.m.RLock()
+	defer reg.m.RUnlock()
+
+	v, ok := reg.data[f.id]
+	return ok && v == f
 }
 
 func (f *FileData) GetId() string {
@@ -281,19 +763,72 @@ func (f *FileData) GetFilename() string {
 }
 
 func (f *FileData) Serve(w http.ResponseWriter, r *http.Request, filename string, mimetype string, timestamp time.Time, attachment bool) error {
+	if f.entry != nil {
+		f.entry.serve(w, r, filename, mimetype, timestamp, attachment)
+		return nil
+	}
+
 	s, err := settings.Get()
 	if err != nil {
 		return err
 	}
 
-	return s.Backend.Serve(w, r, f.id, filename, mimetype, timestamp, attachment)
+	ctx, cancel := withTimeout(r.Context(), s.BackendTimeoutServe)
+	defer cancel()
+
+	return s.Backend.Serve(ctx, w, r, f.id, filename, mimetype, timestamp, attachment)
 }
 
-func (f *FileData) Read() (io.ReadCloser, error) {
+func (f *FileData) Read(ctx context.Context) (io.ReadCloser, error) {
+	if f.entry != nil {
+		return f.entry.read(), nil
+	}
+
 	s, err := settings.Get()
 	if err != nil {
 		return nil, err
 	}
 
-	return s.Backend.Read(f.id)
+	// the timeout covers reading the data, not just opening the file
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutRead)
+	fp, err := s.Backend.Read(ctx, f.id)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &readCloser{ReadCloser: fp, cancel: cancel}, nil
+}
+
+// OpenReaderAt opens the file for reads at arbitrary offsets, for formats
+// that can't be streamed, like zip files. Remote files are read using ranged
+// requests, instead of being downloaded completely.
+func (f *FileData) OpenReaderAt(ctx context.Context) (ReadAtCloser, error) {
+	if f.entry != nil {
+		return f.entry.readAt(), nil
+	}
+
+	s, err := settings.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutRead)
+
+	// local files support ReadAt already
+	if _, ok := backends.Unwrap(s.Backend).(backends.RangeReader); !ok {
+		fp, err := s.Backend.Read(ctx, f.id)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if ra, ok := fp.(ReadAtCloser); ok {
+			return &readAtCloser{ReadAtCloser: ra, cancel: cancel}, nil
+		}
+		fp.Close()
+	}
+
+	ra := rangereader.NewReaderAt(f.Size, func(offset int64) (io.ReadCloser, error) {
+		return backends.ReadRange(ctx, s.Backend, f.id, offset)
+	})
+	return &readAtCloser{ReadAtCloser: ra, cancel: cancel}, nil
 }
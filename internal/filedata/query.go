@@ -0,0 +1,179 @@
+package filedata
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danwakefield/fnmatch"
+)
+
+var (
+	ErrInvalidQuery = errors.New("filedata: invalid query")
+)
+
+// Query selects files from the registry. Zero values disable the
+// corresponding filters.
+type Query struct {
+	Mimetype string
+	Filename string
+	Since    time.Time
+	Until    time.Time
+	MinSize  int64
+	MaxSize  int64
+	Tags     []string
+
+	Sort    string
+	Reverse bool
+
+	Limit  int
+	Cursor string
+}
+
+func (q *Query) match(fd *FileData) bool {
+	if q.Mimetype != "" && !fnmatch.Match(q.Mimetype, fd.Mimetype, fnmatch.FNM_IGNORECASE) {
+		return false
+	}
+	if q.Filename != "" && !fnmatch.Match(q.Filename, fd.Filename, fnmatch.FNM_IGNORECASE) {
+		return false
+	}
+	if !q.Since.IsZero() && fd.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && fd.Timestamp.After(q.Until) {
+		return false
+	}
+	if q.MinSize > 0 && fd.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && fd.Size > q.MaxSize {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !fd.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the value used to sort the files. the file id is always used
+// to break ties, so that the order is stable between requests.
+func (q *Query) key(fd *FileData) string {
+	switch q.Sort {
+	case "size":
+		return strconv.FormatInt(fd.Size, 10)
+	case "name":
+		return fd.Filename
+	}
+	return strconv.FormatInt(fd.Timestamp.UnixNano(), 10)
+}
+
+func (q *Query) less(a *FileData, b *FileData) bool {
+	switch q.Sort {
+	case "size":
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case "name":
+		an, bn := strings.ToLower(a.Filename), strings.ToLower(b.Filename)
+		if an != bn {
+			return an < bn
+		}
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+	default:
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+	}
+	return a.id < b.id
+}
+
+// cursors point to the last file of the previous page, instead of using
+// offsets, to avoid skipping files when new files are uploaded.
+func (q *Query) encodeCursor(fd *FileData) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%t|%s|%s", q.Sort, q.Reverse, fd.id, q.key(fd))))
+}
+
+func (q *Query) decodeCursor() (*FileData, error) {
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad cursor", ErrInvalidQuery)
+	}
+
+	pieces := strings.SplitN(string(data), "|", 4)
+	if len(pieces) != 4 || pieces[0] != q.Sort || pieces[1] != strconv.FormatBool(q.Reverse) {
+		return nil, fmt.Errorf("%w: bad cursor", ErrInvalidQuery)
+	}
+
+	rv := &FileData{id: pieces[2]}
+	switch q.Sort {
+	case "size":
+		rv.Size, err = strconv.ParseInt(pieces[3], 10, 64)
+	case "name":
+		rv.Filename = pieces[3]
+	default:
+		var ts int64
+		ts, err = strconv.ParseInt(pieces[3], 10, 64)
+		rv.Timestamp = time.Unix(0, ts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad cursor", ErrInvalidQuery)
+	}
+	return rv, nil
+}
+
+// List returns the files selected by the query, and a cursor for the next
+// page, if any.
+func List(q *Query) ([]*FileData, string, error) {
+	switch q.Sort {
+	case "", "date", "size", "name":
+	default:
+		return nil, "", fmt.Errorf("%w: invalid sort: %s", ErrInvalidQuery, q.Sort)
+	}
+	if q.Limit < 0 {
+		return nil, "", fmt.Errorf("%w: invalid limit", ErrInvalidQuery)
+	}
+	if q.MinSize < 0 || q.MaxSize < 0 {
+		return nil, "", fmt.Errorf("%w: invalid size", ErrInvalidQuery)
+	}
+
+	var cursor *FileData
+	if q.Cursor != "" {
+		var err error
+		cursor, err = q.decodeCursor()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	less := func(a *FileData, b *FileData) bool {
+		if q.Reverse {
+			return q.less(b, a)
+		}
+		return q.less(a, b)
+	}
+
+	rv := []*FileData{}
+	ForEach(func(fd *FileData) {
+		if q.match(fd) && (cursor == nil || less(cursor, fd)) {
+			rv = append(rv, fd)
+		}
+	})
+
+	sort.SliceStable(rv, func(i int, j int) bool {
+		return less(rv[i], rv[j])
+	})
+
+	if q.Limit > 0 && len(rv) > q.Limit {
+		rv = rv[:q.Limit]
+		return rv, q.encodeCursor(rv[len(rv)-1]), nil
+	}
+	return rv, "", nil
+}
@@ -0,0 +1,78 @@
+package filedata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// the limits are low because some backends store metadata in http headers,
+// e.g. S3 allows just 2KB of user metadata per object.
+const (
+	maxDescriptionLength = 512
+	maxTags              = 10
+	maxTagLength         = 32
+)
+
+var (
+	ErrInvalidMetadata = errors.New("filedata: invalid metadata")
+)
+
+func validTagChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == ':'
+}
+
+// ParseTags parses tags from form values, that may also include several tags
+// separated by commas or spaces. Tags are case insensitive.
+func ParseTags(values []string) ([]string, error) {
+	rv := []string{}
+	seen := map[string]bool{}
+
+	for _, value := range values {
+		for _, tag := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			tag = strings.ToLower(tag)
+			if len(tag) > maxTagLength {
+				return nil, fmt.Errorf("%w: tag too long: %s", ErrInvalidMetadata, tag)
+			}
+			for i := 0; i < len(tag); i++ {
+				if !validTagChar(tag[i]) {
+					return nil, fmt.Errorf("%w: invalid tag: %s", ErrInvalidMetadata, tag)
+				}
+			}
+
+			if !seen[tag] {
+				seen[tag] = true
+				rv = append(rv, tag)
+			}
+		}
+	}
+
+	if len(rv) > maxTags {
+		return nil, fmt.Errorf("%w: too many tags", ErrInvalidMetadata)
+	}
+	return rv, nil
+}
+
+func validateDescription(description string) error {
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("%w: description too long", ErrInvalidMetadata)
+	}
+	if !utf8.ValidString(description) {
+		return fmt.Errorf("%w: invalid description", ErrInvalidMetadata)
+	}
+	return nil
+}
+
+// HasTag checks if the file was tagged with the given tag.
+func (f *FileData) HasTag(tag string) bool {
+	tag = strings.ToLower(tag)
+	for _, t := range f.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbnailSize = 256
+
+	// decoding an image requires a few bytes per pixel, so images must be
+	// limited to not exhaust the memory
+	thumbnailMaxPixels = 50 * 1000 * 1000
+
+	// bigger files are not read at all, even if valid images
+	thumbnailMaxSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrNoThumbnail = errors.New("filedata: thumbnail not available")
+
+	thumbnailMimetypes = map[string]bool{
+		"image/gif":  true,
+		"image/jpeg": true,
+		"image/png":  true,
+		"image/webp": true,
+	}
+
+	thumbs = &thumbnails{running: map[string]chan struct{}{}}
+)
+
+type thumbnails struct {
+	running map[string]chan struct{}
+	m       sync.Mutex
+}
+
+// thumbnailId returns the id used to store the thumbnail in the backend. It
+// is never a valid upload id, so thumbnails are not registered as files.
+func thumbnailId(fid string) string {
+	return fid + ".thumb"
+}
+
+// SupportsThumbnail checks if thumbnails can be generated for files of the
+// given mimetype.
+func SupportsThumbnail(mimetype string) bool {
+	return thumbnailMimetypes[mimetype]
+}
+
+// ImageSize returns the dimensions of an image, reading just its header.
+func (f *FileData) ImageSize(ctx context.Context) (int, int, error) {
+	if !SupportsThumbnail(f.Mimetype) {
+		return 0, 0, ErrNoThumbnail
+	}
+
+	fp, err := f.Read(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fp.Close()
+
+	cfg, _, err := image.DecodeConfig(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+func (f *FileData) decodeImage(ctx context.Context) (image.Image, string, error) {
+	if f.Size > thumbnailMaxSize {
+		return nil, "", fmt.Errorf("file too large: %d bytes", f.Size)
+	}
+
+	// the header is checked before the image is decoded, and the file is
+	// read again instead of being kept in memory
+	w, h, err := f.ImageSize(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if w <= 0 || h <= 0 || int64(w)*int64(h) > thumbnailMaxPixels {
+		return nil, "", fmt.Errorf("image too large: %dx%d", w, h)
+	}
+
+	fp, err := f.Read(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer fp.Close()
+
+	// gif animations are represented by their first frame
+	return image.Decode(io.LimitReader(fp, thumbnailMaxSize))
+}
+
+func (f *FileData) generateThumbnail(ctx context.Context) error {
+	s, err := settings.Get()
+	if err != nil {
+		return err
+	}
+
+	src, format, err := f.decodeImage(ctx)
+	if err != nil {
+		return err
+	}
+
+	// smaller images are not scaled up
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w > thumbnailSize || h > thumbnailSize {
+		if w >= h {
+			w, h = thumbnailSize, max(1, h*thumbnailSize/w)
+		} else {
+			w, h = max(1, w*thumbnailSize/h), thumbnailSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	// jpeg thumbnails are smaller, but transparency must be kept for the
+	// other formats
+	buf := &bytes.Buffer{}
+	mimetype := "image/png"
+	ext := ".png"
+	if format == "jpeg" {
+		mimetype = "image/jpeg"
+		ext = ".jpg"
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(buf, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutWrite)
+	defer cancel()
+
+	tid := thumbnailId(f.id)
+	_, err = s.Backend.Write(ctx, tid, buf, &metadata.Metadata{
+		Filename:  tid + ext,
+		Mimetype:  mimetype,
+		Timestamp: time.Now().UTC(),
+	})
+
+	// generated by another instance in the meantime
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// thumbnail returns the metadata of the thumbnail, generating it if needed.
+// concurrent requests for the same thumbnail wait for a single generation.
+func (f *FileData) thumbnail(ctx context.Context) (*metadata.Metadata, error) {
+	s, err := settings.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	readMetadata := func() (*metadata.Metadata, error) {
+		mctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+		defer cancel()
+		return s.Backend.ReadMetadata(mctx, thumbnailId(f.id))
+	}
+
+	m, err := readMetadata()
+	if err == nil || !os.IsNotExist(err) {
+		return m, err
+	}
+
+	thumbs.m.Lock()
+	ch, ok := thumbs.running[f.id]
+	if !ok {
+		ch = make(chan struct{})
+		thumbs.running[f.id] = ch
+	}
+	thumbs.m.Unlock()
+
+	if ok {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ch:
+		}
+	} else {
+		err := f.generateThumbnail(ctx)
+
+		thumbs.m.Lock()
+		delete(thumbs.running, f.id)
+		close(ch)
+		thumbs.m.Unlock()
+
+		if err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				return nil, cerr
+			}
+			log.Printf("error: filedata: thumbnail: %s: %s", f.id, err)
+			return nil, ErrNoThumbnail
+		}
+	}
+
+	m, err = readMetadata()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoThumbnail
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// ServeThumbnail serves a thumbnail of the file, generated when first
+// requested and stored in the backend. ErrNoThumbnail is returned for files
+// that are not supported images, or that could not be decoded, and for
+// archive entries.
+func (f *FileData) ServeThumbnail(w http.ResponseWriter, r *http.Request) error {
+	if f.entry != nil || !SupportsThumbnail(f.Mimetype) {
+		return ErrNoThumbnail
+	}
+
+	s, err := settings.Get()
+	if err != nil {
+		return err
+	}
+
+	m, err := f.thumbnail(r.Context())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.BackendTimeoutServe)
+	defer cancel()
+
+	return s.Backend.Serve(ctx, w, r, thumbnailId(f.id), m.Filename, m.Mimetype, m.Timestamp, false)
+}
+
+func deleteThumbnail(ctx context.Context, fid string) {
+	s, err := settings.Get()
+	if err != nil {
+		log.Printf("error: %s", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+	defer cancel()
+
+	if err := s.Backend.Delete(ctx, thumbnailId(fid)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: filedata: thumbnail: %s: %s", fid, err)
+	}
+}
+
+// cleanupThumbnail removes the thumbnails of files removed from the registry
+// for any reason, including files expired or removed by fsck.
+func cleanupThumbnail(e *Event) {
+	if e.Removed() && SupportsThumbnail(e.File.Mimetype) {
+		go deleteThumbnail(context.Background(), e.File.id)
+	}
+}
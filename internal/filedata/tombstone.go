@@ -0,0 +1,113 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/id"
+	"github.com/rafaelmartins/filebin/internal/settings"
+)
+
+const (
+	// tombstones must be kept until every instance reconciled its registry
+	minTombstoneTTL = time.Hour
+)
+
+var (
+	tombs = &tombstones{seen: map[string]time.Time{}}
+)
+
+// tombstones tracks when each tombstone was first listed by this instance,
+// so that they can be removed without reading their metadata.
+type tombstones struct {
+	seen map[string]time.Time
+	m    sync.Mutex
+}
+
+// tombstoneId returns the id of the marker stored in the backend when a file
+// is deleted, so that other instances sharing the backend can tell deleted
+// files from files that expired. Like thumbnails, tombstones are never
+// registered as files.
+func tombstoneId(fid string) string {
+	return fid + ".deleted"
+}
+
+// parseTombstoneId returns the id of the deleted file, if v is a tombstone.
+func parseTombstoneId(v string) (string, bool) {
+	if fid := strings.TrimSuffix(v, ".deleted"); fid != v && id.Valid(fid) {
+		return fid, true
+	}
+	return "", false
+}
+
+// writeTombstone is only useful if the registry is reconciled, and failures
+// just cause the deletion to be reported as expiration by other instances.
+func writeTombstone(ctx context.Context, fid string) {
+	s, err := settings.Get()
+	if err != nil {
+		log.Printf("error: %s", err)
+		return
+	}
+	if s.ReconcileInterval == 0 {
+		return
+	}
+
+	ctx, cancel := withTimeout(ctx, s.BackendTimeoutWrite)
+	defer cancel()
+
+	tid := tombstoneId(fid)
+	if _, err := s.Backend.Write(ctx, tid, bytes.NewReader(nil), &metadata.Metadata{
+		Filename:  tid,
+		Mimetype:  "application/octet-stream",
+		Timestamp: time.Now().UTC(),
+	}); err != nil && !os.IsExist(err) {
+		log.Printf("error: filedata: tombstone: %s: %s", fid, err)
+	}
+}
+
+// cleanup removes the tombstones listed for longer than the ttl.
+func (t *tombstones) cleanup(ctx context.Context, deleted map[string]bool) {
+	s, err := settings.Get()
+	if err != nil {
+		log.Printf("error: %s", err)
+		return
+	}
+
+	ttl := minTombstoneTTL
+	if v := 2 * s.ReconcileInterval; v > ttl {
+		ttl = v
+	}
+
+	now := time.Now()
+	expired := []string{}
+
+	t.m.Lock()
+	for fid := range t.seen {
+		if !deleted[fid] {
+			delete(t.seen, fid)
+		}
+	}
+	for fid := range deleted {
+		if first, ok := t.seen[fid]; !ok {
+			t.seen[fid] = now
+		} else if now.Sub(first) >= ttl {
+			expired = append(expired, fid)
+			delete(t.seen, fid)
+		}
+	}
+	t.m.Unlock()
+
+	for _, fid := range expired {
+		dctx, cancel := withTimeout(ctx, s.BackendTimeoutMetadata)
+		if err := s.Backend.Delete(dctx, tombstoneId(fid)); err != nil && !os.IsNotExist(err) {
+			log.Printf("error: filedata: tombstone: %s: %s", fid, err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,244 @@
+package fsck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+	"github.com/rafaelmartins/filebin/internal/mime"
+)
+
+type Kind string
+
+const (
+	MissingData        Kind = "missing-data"
+	MissingMetadata    Kind = "missing-metadata"
+	UnreadableMetadata Kind = "unreadable-metadata"
+	UnreadableData     Kind = "unreadable-data"
+	SizeMismatch       Kind = "size-mismatch"
+	StaleRegistry      Kind = "stale-registry"
+)
+
+type Action string
+
+const (
+	Report     Action = ""
+	Repair     Action = "repair"
+	Quarantine Action = "quarantine"
+	Delete     Action = "delete"
+)
+
+var (
+	ErrNotRepairable = errors.New("fsck: problem can't be repaired")
+	ErrInvalidAction = errors.New("fsck: invalid action")
+)
+
+type Problem struct {
+	Id     string `json:"id"`
+	Kind   Kind   `json:"kind"`
+	Detail string `json:"detail"`
+
+	// the metadata that could be read, if any
+	m *metadata.Metadata
+}
+
+// ParseAction validates an action name, as used in the command line and in
+// the admin endpoint.
+func ParseAction(v string) (Action, error) {
+	switch a := Action(v); a {
+	case Report, Repair, Quarantine, Delete:
+		return a, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidAction, v)
+}
+
+func checkData(ctx context.Context, b backends.Backend, id string, m *metadata.Metadata) *Problem {
+	// the cache may have a valid copy of a file that was broken in the
+	// backend afterwards
+	fp, err := backends.Unwrap(b).Read(ctx, id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Problem{Id: id, Kind: MissingData, Detail: "metadata without data", m: m}
+		}
+		return &Problem{Id: id, Kind: UnreadableData, Detail: err.Error(), m: m}
+	}
+	defer fp.Close()
+
+	n, err := io.Copy(ioutil.Discard, fp)
+	if err != nil {
+		return &Problem{Id: id, Kind: UnreadableData, Detail: err.Error(), m: m}
+	}
+	if n != m.Size {
+		return &Problem{Id: id, Kind: SizeMismatch, Detail: fmt.Sprintf("metadata: %d bytes, data: %d bytes", m.Size, n), m: m}
+	}
+	return nil
+}
+
+// Check finds files that can't be handled by filebin. If deep is true, the
+// data of every file is read, to make sure that it is available and matches
+// the size reported by the backend. If known is not nil, it must map the ids
+// registered by a running filebin instance to their sizes, to find files
+// changed in the backend after being registered.
+//
+// Uploads in progress may be reported as problems, when checking a backend
+// used by running filebin instances.
+func Check(ctx context.Context, b backends.Backend, deep bool, known map[string]int64) ([]*Problem, error) {
+	ids, err := b.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	rv := []*Problem{}
+	for _, id := range ids {
+		m, err := b.ReadMetadata(ctx, id)
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if os.IsNotExist(err) {
+				rv = append(rv, &Problem{Id: id, Kind: MissingData, Detail: "metadata without data"})
+			} else {
+				rv = append(rv, &Problem{Id: id, Kind: UnreadableMetadata, Detail: err.Error()})
+			}
+			continue
+		}
+
+		// objects uploaded to the bucket by other tools
+		if m.Mimetype == "" || m.Timestamp.IsZero() {
+			rv = append(rv, &Problem{Id: id, Kind: MissingMetadata, Detail: "incomplete metadata", m: m})
+			continue
+		}
+
+		if size, ok := known[id]; ok && size != m.Size {
+			rv = append(rv, &Problem{Id: id, Kind: StaleRegistry, Detail: fmt.Sprintf("registered: %d bytes, backend: %d bytes", size, m.Size), m: m})
+			continue
+		}
+
+		if deep {
+			if p := checkData(ctx, b, id, m); p != nil {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				rv = append(rv, p)
+			}
+		}
+	}
+
+	if ol, ok := backends.Unwrap(b).(backends.OrphanLister); ok {
+		orphans, err := ol.ListOrphans(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(orphans)
+
+		for _, id := range orphans {
+			rv = append(rv, &Problem{Id: id, Kind: MissingMetadata, Detail: "data without metadata"})
+		}
+	}
+
+	return rv, nil
+}
+
+// repair creates new metadata for the file, keeping what could be read from
+// the backend.
+func repair(ctx context.Context, b backends.Backend, p *Problem) error {
+	if p.Kind != MissingMetadata && p.Kind != UnreadableMetadata {
+		return ErrNotRepairable
+	}
+
+	mw, ok := backends.Unwrap(b).(backends.MetadataWriter)
+	if !ok {
+		return fmt.Errorf("fsck: %s backend does not support writing metadata", b.Name())
+	}
+
+	m := &metadata.Metadata{}
+	if p.m != nil {
+		*m = *p.m
+	}
+	if m.Filename == "" {
+		m.Filename = p.Id
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+	if m.Mimetype == "" {
+		fp, err := backends.Unwrap(b).Read(ctx, p.Id)
+		if err != nil {
+			return err
+		}
+		mt, err := mime.DetectFromFilename(fp, m.Filename)
+		fp.Close()
+		if err != nil {
+			mt = "application/octet-stream"
+		}
+		m.Mimetype = mt
+	}
+
+	return mw.WriteMetadata(ctx, p.Id, m)
+}
+
+// Fix applies an action to the files related to a problem. Stale registries
+// are never destructive: the files in the backend are fine, and the caller
+// must just refresh its registry, whatever the action.
+func Fix(ctx context.Context, b backends.Backend, p *Problem, action Action) error {
+	if p.Kind == StaleRegistry && (action == Repair || action == Quarantine || action == Delete) {
+		return nil
+	}
+
+	switch action {
+	case Repair:
+		return repair(ctx, b, p)
+
+	case Quarantine:
+		return backends.Quarantine(ctx, b, p.Id)
+
+	case Delete:
+		// backends may fail to remove the missing part of the file
+		if err := b.Delete(ctx, p.Id); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrInvalidAction, action)
+}
+
+// Run checks the backend and fixes the problems found, if an action is
+// given, reporting the progress to w.
+func Run(ctx context.Context, b backends.Backend, deep bool, action Action, w io.Writer) error {
+	problems, err := Check(ctx, b, deep, nil)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, p := range problems {
+		fmt.Fprintf(w, "[%d/%d] %s: %s: %s\n", i+1, len(problems), p.Id, p.Kind, p.Detail)
+		if action == Report {
+			continue
+		}
+
+		if err := Fix(ctx, b, p, action); err != nil {
+			failed++
+			fmt.Fprintf(w, "[%d/%d] %s: %s failed: %s\n", i+1, len(problems), p.Id, action, err)
+			continue
+		}
+		fmt.Fprintf(w, "[%d/%d] %s: %s done\n", i+1, len(problems), p.Id, action)
+	}
+
+	if action == Report && len(problems) > 0 {
+		return fmt.Errorf("fsck: found %d problems", len(problems))
+	}
+	if failed > 0 {
+		return fmt.Errorf("fsck: failed to fix %d of %d problems", failed, len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package fsck
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/local"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+)
+
+func TestFixStaleRegistry(t *testing.T) {
+	ctx := context.Background()
+
+	b, err := local.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write(ctx, "foo", bytes.NewBufferString("hello"), &metadata.Metadata{
+		Filename:  "foo.txt",
+		Mimetype:  "text/plain",
+		Timestamp: time.Now().UTC(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Check(ctx, b, true, map[string]int64{"foo": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != StaleRegistry {
+		t.Fatalf("unexpected problems: %+v", problems)
+	}
+
+	// healthy files must survive destructive actions
+	for _, action := range []Action{Delete, Quarantine, Repair} {
+		if err := Fix(ctx, b, problems[0], action); err != nil {
+			t.Errorf("%s: %s", action, err)
+		}
+		if _, err := b.ReadMetadata(ctx, "foo"); err != nil {
+			t.Errorf("%s: file removed: %s", action, err)
+		}
+	}
+
+	if err := Fix(ctx, b, problems[0], "bola"); err == nil {
+		t.Error("expected invalid action error")
+	}
+}
@@ -42,3 +42,17 @@ func Generate(length uint8) (string, error) {
 	}
 	return t.String(), nil
 }
+
+// Valid checks if the given string could have been generated by Generate. It
+// does not validate the length, because it may have been changed.
+func Valid(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(chars, s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+)
+
+// Migrate copies every file from a backend to another, preserving metadata.
+// Files already available in the destination backend with the correct size
+// are skipped, so that an interrupted migration can be resumed.
+func Migrate(ctx context.Context, from backends.Backend, to backends.Backend, w io.Writer) error {
+	ids, err := from.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+
+	failed := 0
+	for i, id := range ids {
+		status, err := migrateFile(ctx, from, to, id)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "[%d/%d] %s: error: %s\n", i+1, len(ids), id, err)
+			continue
+		}
+		fmt.Fprintf(w, "[%d/%d] %s: %s\n", i+1, len(ids), id, status)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("migrate: failed to migrate %d of %d files", failed, len(ids))
+	}
+	return nil
+}
+
+func migrateFile(ctx context.Context, from backends.Backend, to backends.Backend, id string) (string, error) {
+	m, err := from.ReadMetadata(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	if dm, err := to.ReadMetadata(ctx, id); err == nil && dm.Size == m.Size {
+		return "skipped, already migrated", nil
+	}
+
+	// leftovers from an interrupted migration may look like missing or
+	// broken files, e.g. the local backend writes the metadata before the
+	// data, and would refuse to write the file again
+	if err := to.Delete(ctx, id); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	fp, err := from.Read(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	n, err := to.Write(ctx, id, fp, m)
+	if err != nil {
+		// the file was written by someone else in the meantime
+		if !os.IsExist(err) {
+			to.Delete(ctx, id)
+		}
+		return "", err
+	}
+
+	if n == m.Size {
+		if dm, err := to.ReadMetadata(ctx, id); err == nil && dm.Size == m.Size {
+			return "migrated", nil
+		}
+	}
+
+	to.Delete(ctx, id)
+	return "", errors.New("mismatched file size")
+}
@@ -0,0 +1,162 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/local"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/metadata"
+)
+
+// interrupted fails to read a file after some bytes, like a migration
+// interrupted while copying data.
+type interrupted struct {
+	backends.Backend
+	id string
+}
+
+type failingReader struct {
+	io.ReadCloser
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("interrupted")
+}
+
+func (i *interrupted) Read(ctx context.Context, id string) (io.ReadCloser, error) {
+	fp, err := i.Backend.Read(ctx, id)
+	if err != nil || id != i.id {
+		return fp, err
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(fp, 2), failingReader{fp}), fp}, nil
+}
+
+// racing writes every file before the migration, like a concurrent writer.
+type racing struct {
+	backends.Backend
+}
+
+func (r *racing) Write(ctx context.Context, id string, rd io.Reader, m *metadata.Metadata) (int64, error) {
+	if _, err := r.Backend.Write(ctx, id, bytes.NewBufferString("other"), m); err != nil {
+		return 0, err
+	}
+	return r.Backend.Write(ctx, id, rd, m)
+}
+
+func newTestLocal(t *testing.T) (*local.Local, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	l, err := local.NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, dir
+}
+
+func TestMigrateResume(t *testing.T) {
+	ctx := context.Background()
+
+	from, _ := newTestLocal(t)
+	to, dir := newTestLocal(t)
+
+	files := map[string]string{
+		"aaaa": "hello world",
+		"bbbb": "bola guarda-chuva",
+		"cccc": "foo",
+		"dddd": "bar",
+	}
+	for id, data := range files {
+		if _, err := from.Write(ctx, id, bytes.NewBufferString(data), &metadata.Metadata{
+			Filename:  id + ".txt",
+			Mimetype:  "text/plain",
+			Timestamp: time.Now().UTC(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Migrate(ctx, &interrupted{Backend: from, id: "bbbb"}, to, ioutil.Discard); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// leftovers of a migration killed while writing: a sidecar without
+	// data, and a truncated sidecar
+	for _, id := range []string{"cccc", "dddd"} {
+		if err := to.Delete(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cccc.json"), []byte(`{"filename":"cccc.txt"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dddd.json"), []byte(`{"filena`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, from, to, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, data := range files {
+		fp, err := to.Read(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ioutil.ReadAll(fp)
+		fp.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d) != data {
+			t.Errorf("%s: unexpected data: %q", id, d)
+		}
+
+		m, err := to.ReadMetadata(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Filename != id+".txt" || m.Mimetype != "text/plain" {
+			t.Errorf("%s: unexpected metadata: %+v", id, m)
+		}
+	}
+}
+
+func TestMigrateConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+
+	from, _ := newTestLocal(t)
+	to, _ := newTestLocal(t)
+
+	if _, err := from.Write(ctx, "aaaa", bytes.NewBufferString("hello world"), &metadata.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, from, &racing{to}, ioutil.Discard); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// the file written by someone else must be kept
+	fp, err := to.Read(ctx, "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	d, err := ioutil.ReadAll(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != "other" {
+		t.Errorf("unexpected data: %q", d)
+	}
+}
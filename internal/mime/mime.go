@@ -62,24 +62,32 @@ func detectFromFilename(filename string) (string, error) {
 	return "", errNotFound
 }
 
-func Detect(f io.Reader, fh *multipart.FileHeader) (string, error) {
-	if f == nil || fh == nil {
+func DetectFromFilename(f io.Reader, filename string) (string, error) {
+	if f == nil {
 		return "", errNotFound
 	}
 
-	if fh.Filename != "-" {
-		if m, err := detectFromFilename(fh.Filename); err == nil && m != "" {
+	if filename != "-" {
+		if m, err := detectFromFilename(filename); err == nil && m != "" {
 			return m, nil
 		}
 	}
 
-	if m, err := detectFromData(f); err == nil && m != "" {
+	return detectFromData(f)
+}
+
+func Detect(f io.Reader, p *multipart.Part) (string, error) {
+	if f == nil || p == nil {
+		return "", errNotFound
+	}
+
+	if m, err := DetectFromFilename(f, p.FileName()); err == nil && m != "" {
 		return m, nil
 	}
 
 	// our last resource is trusting the mime type sent by http client
 	// this is usually good enough for browsers, but not enough for curl
-	for key, l := range fh.Header {
+	for key, l := range p.Header {
 		if len(l) > 0 && contentType == key {
 			return l[0], nil
 		}
@@ -0,0 +1,259 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/mime"
+)
+
+const (
+	// entries are extracted to memory to be rendered
+	maxEntrySize = 32 * 1024 * 1024
+
+	// tarballs must be read from the start to find an entry, and compressed
+	// tarballs may expand to much more than their size
+	maxArchiveSize = 256 * 1024 * 1024
+	maxWalkSize    = 1024 * 1024 * 1024
+)
+
+var (
+	ErrEntryNotFound   = errors.New("archive: entry not found")
+	ErrEntryTooLarge   = errors.New("archive: entry too large")
+	ErrArchiveTooLarge = errors.New("archive: archive too large")
+
+	errNotArchive = errors.New("archive: not an archive")
+
+	// compressed tarballs are detected from the data, because the mimetype
+	// of files like *.tar.gz is usually just the compression format.
+	mimetypes = map[string]bool{
+		"application/gzip":              true,
+		"application/x-compressed-tar":  true,
+		"application/x-gtar":            true,
+		"application/x-gtar-compressed": true,
+		"application/x-gzip":            true,
+		"application/x-tar":             true,
+		"application/x-ustar":           true,
+		"application/x-zstd":            true,
+		"application/zip":               true,
+		"application/zstd":              true,
+	}
+
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZip  = []byte("PK\x03\x04")
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type Entry struct {
+	Name     string
+	Size     int64
+	Mode     fs.FileMode
+	Modified time.Time
+	Link     string
+
+	// the path used in urls, only set for regular files
+	Path string
+}
+
+type walkFunc func(e *Entry, open func() (io.ReadCloser, error)) (bool, error)
+
+func supports(mimetype string) bool {
+	return mimetypes[mimetype]
+}
+
+// cleanPath normalizes member names, that may be relative to the current
+// directory, to match the paths in urls, that are cleaned by the router.
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// limitReader fails after reading n bytes, unlike io.LimitReader, so that
+// a walk that is too long isn't mistaken for a truncated archive.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrArchiveTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func walkTar(r io.Reader, f walkFunc) error {
+	tr := tar.NewReader(&limitReader{r: r, n: maxWalkSize})
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if i == 0 {
+				return errNotArchive
+			}
+			return err
+		}
+
+		e := &Entry{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Mode:     hdr.FileInfo().Mode(),
+			Modified: hdr.ModTime,
+			Link:     hdr.Linkname,
+		}
+		if e.Mode.IsRegular() {
+			e.Path = cleanPath(hdr.Name)
+		}
+
+		cont, err := f(e, func() (io.ReadCloser, error) {
+			return io.NopCloser(tr), nil
+		})
+		if err != nil || !cont {
+			return err
+		}
+	}
+}
+
+func walkZip(r io.ReaderAt, size int64, f walkFunc) error {
+	// only the central directory and the requested entries are read
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errNotArchive
+	}
+
+	for _, zf := range zr.File {
+		e := &Entry{
+			Name:     zf.Name,
+			Size:     int64(zf.UncompressedSize64),
+			Mode:     zf.Mode(),
+			Modified: zf.Modified,
+		}
+		if e.Mode.IsRegular() {
+			e.Path = cleanPath(zf.Name)
+		}
+
+		cont, err := f(e, zf.Open)
+		if err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk calls f for each member of the archive, until it returns false.
+func walk(ctx context.Context, fd *filedata.FileData, f walkFunc) error {
+	if fd.Size > maxArchiveSize {
+		return ErrArchiveTooLarge
+	}
+
+	// zip files must be read from the end, and remote files are read using
+	// ranged requests instead of being downloaded
+	fp, err := fd.OpenReaderAt(ctx)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	magic := make([]byte, 4)
+	n, _ := fp.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	if bytes.HasPrefix(magic, magicZip) {
+		return walkZip(fp, fd.Size, f)
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(fp, 0, fd.Size))
+
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return errNotArchive
+		}
+		defer gr.Close()
+		return walkTar(gr, f)
+
+	case bytes.HasPrefix(magic, magicZstd):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxWalkSize))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return walkTar(zr, f)
+	}
+
+	return walkTar(br, f)
+}
+
+// Extract reads a regular file from an archive, returning it as a file that
+// can be rendered.
+func Extract(ctx context.Context, fd *filedata.FileData, p string) (*filedata.FileData, error) {
+	if fd.IsEntry() || !supports(fd.Mimetype) || p == "" {
+		return nil, ErrEntryNotFound
+	}
+
+	var rv *filedata.FileData
+	err := walk(ctx, fd, func(e *Entry, open func() (io.ReadCloser, error)) (bool, error) {
+		if e.Path != p {
+			return true, nil
+		}
+		if e.Size > maxEntrySize {
+			return false, ErrEntryTooLarge
+		}
+
+		r, err := open()
+		if err != nil {
+			return false, err
+		}
+		defer r.Close()
+
+		// the size in the headers is not trusted
+		data, err := io.ReadAll(io.LimitReader(r, maxEntrySize+1))
+		if err != nil {
+			return false, err
+		}
+		if len(data) > maxEntrySize {
+			return false, ErrEntryTooLarge
+		}
+
+		mt, err := mime.DetectFromFilename(bytes.NewReader(data), path.Base(p))
+		if err != nil {
+			mt = "application/octet-stream"
+		}
+
+		rv = filedata.NewEntry(fd, p, data, mt, e.Modified)
+		return false, nil
+	})
+	if err != nil {
+		if errors.Is(err, errNotArchive) {
+			return nil, ErrEntryNotFound
+		}
+		if errors.Is(err, ErrArchiveTooLarge) || errors.Is(err, ErrEntryTooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("archive: %s: %w", fd.GetId(), err)
+	}
+	if rv == nil {
+		return nil, ErrEntryNotFound
+	}
+	return rv, nil
+}
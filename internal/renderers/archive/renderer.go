@@ -0,0 +1,145 @@
+package archive
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/renderers/raw"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+const (
+	maxEntries = 10000
+)
+
+var (
+	tmplArchive = template.Must(template.New("archive").Funcs(template.FuncMap{
+		"size":   utils.FormatSize,
+		"escape": escapePath,
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+<title>filebin — {{.Fd.GetFilename}}</title>
+<style type="text/css">
+table { border-collapse: collapse; margin-bottom: 1em; font-family: monospace; }
+th, td { padding: 0.1em 0.8em; text-align: left; white-space: nowrap; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<p>
+<strong>File:</strong> {{.Fd.GetFilename}} |
+<strong>Type:</strong> {{.Fd.Mimetype}} |
+<strong>Size:</strong> {{size .Fd.Size}} |
+<strong>Created on:</strong> {{.Timestamp}} |
+<strong>Entries:</strong> {{len .Entries}}{{if .Truncated}}+{{end}} |
+{{- if .Fd.Tags}}
+<strong>Tags:</strong>{{range .Fd.Tags}} <a href="/list?tag={{.}}">{{.}}</a>{{end}} |
+{{- end}}
+<a href="{{.Fd.DownloadPath}}">Download</a>
+{{- if .Fd.Description}}
+<br>
+<strong>Description:</strong> {{.Fd.Description}}
+{{- end}}
+</p>
+{{- if .Truncated}}
+<p>Only the first {{len .Entries}} entries are listed.</p>
+{{- end}}
+{{- if .Broken}}
+<p>The archive is broken, only the entries that could be read are listed.</p>
+{{- end}}
+<table>
+<tr><th>Mode</th><th>Size</th><th>Modified</th><th>Name</th></tr>
+{{- range .Entries}}
+<tr>
+<td>{{.Mode}}</td>
+<td class="n" title="{{.Size}} bytes">{{if .Mode.IsRegular}}{{size .Size}}{{end}}</td>
+<td>{{if not .Modified.IsZero}}{{.Modified.Format "02-01-2006 15:04:05"}}{{end}}</td>
+<td>{{if .Path}}<a href="{{$.Fd.Path}}/entry/{{escape .Path}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}{{if .Link}} → {{.Link}}{{end}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+)
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, v := range parts {
+		parts[i] = url.PathEscape(v)
+	}
+	return strings.Join(parts, "/")
+}
+
+type ArchiveRenderer struct{}
+
+func (h *ArchiveRenderer) Name() string {
+	return "archive"
+}
+
+func (h *ArchiveRenderer) Supports(mimetype string) bool {
+	return supports(mimetype)
+}
+
+func (h *ArchiveRenderer) Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
+	// entries of archives inside archives can't be linked
+	if fd.IsEntry() {
+		return (&raw.RawRenderer{}).Render(w, r, fd)
+	}
+
+	entries := []*Entry{}
+	truncated := false
+	err := walk(r.Context(), fd, func(e *Entry, open func() (io.ReadCloser, error)) (bool, error) {
+		if len(entries) == maxEntries {
+			truncated = true
+			return false, nil
+		}
+		entries = append(entries, e)
+		return true, nil
+	})
+
+	broken := false
+	if err != nil {
+		// compressed files are not always tarballs, and big archives are
+		// too expensive to list
+		if errors.Is(err, errNotArchive) || (errors.Is(err, ErrArchiveTooLarge) && len(entries) == 0) {
+			return (&raw.RawRenderer{}).Render(w, r, fd)
+		}
+		if errors.Is(err, ErrArchiveTooLarge) {
+			truncated = true
+		} else {
+			if len(entries) == 0 {
+				return err
+			}
+			log.Printf("error: archive: %s: %s", fd.GetId(), err)
+			broken = true
+		}
+	}
+
+	d := struct {
+		Fd        *filedata.FileData
+		Timestamp string
+		Entries   []*Entry
+		Truncated bool
+		Broken    bool
+	}{
+		Fd:        fd,
+		Timestamp: fd.Timestamp.Format("02-01-2006 15:04:05"),
+		Entries:   entries,
+		Truncated: truncated,
+		Broken:    broken,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	return tmplArchive.Execute(w, d)
+}
@@ -0,0 +1,323 @@
+package csv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+const (
+	// browsers get too slow with bigger tables
+	maxRows    = 5000
+	maxColumns = 256
+
+	// records are read in memory, and a single record may be as big as the
+	// file
+	maxBytes = 8 * 1024 * 1024
+
+	// bytes used to detect the delimiter
+	sampleSize = 64 * 1024
+	sampleRows = 20
+)
+
+var (
+	// *.csv files are detected as text/comma-separated-values
+	mimetypes = map[string]bool{
+		"text/comma-separated-values": true,
+		"text/csv":                    true,
+		"text/tab-separated-values":   true,
+	}
+
+	delimiters = []struct {
+		r    rune
+		name string
+	}{
+		{',', "comma"},
+		{'\t', "tab"},
+		{';', "semicolon"},
+		{'|', "pipe"},
+	}
+
+	tmplCsv = template.Must(template.New("csv").Funcs(template.FuncMap{
+		"size": utils.FormatSize,
+		"inc": func(i int) int {
+			return i + 1
+		},
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+<title>filebin — {{.Fd.GetFilename}}</title>
+<style type="text/css">
+.table { overflow: auto; max-height: 85vh; margin-bottom: 1em; }
+table { border-collapse: collapse; font-family: monospace; }
+th, td { padding: 0.1em 0.6em; border: 1px solid #ccc; text-align: left; white-space: pre; }
+thead th { position: sticky; top: 0; background-color: #eee; cursor: pointer; user-select: none; }
+thead th[data-sort="asc"]::after { content: " ▲"; }
+thead th[data-sort="desc"]::after { content: " ▼"; }
+td.n { color: #999; text-align: right; }
+</style>
+</head>
+<body>
+<div class="table">
+<table>
+<thead>
+<tr><th>#</th>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+</thead>
+<tbody>
+{{- range $i, $row := .Rows}}
+<tr><td class="n">{{inc $i}}</td>{{range $row}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+</div>
+<strong>File:</strong> {{.Fd.GetFilename}} |
+<strong>Delimiter:</strong> {{.Delimiter}} |
+<strong>Rows:</strong> {{len .Rows}}{{if .Truncated}}+{{end}} |
+<strong>Columns:</strong> {{len .Header}} |
+<strong>Size:</strong> {{size .Fd.Size}} |
+<strong>Created on:</strong> {{.Timestamp}} |
+{{- if .Fd.Tags}}
+<strong>Tags:</strong>{{range .Fd.Tags}} <a href="/list?tag={{.}}">{{.}}</a>{{end}} |
+{{- end}}
+<a href="{{.Fd.TextPath}}">Plain text</a> |
+<a href="{{.Fd.DownloadPath}}">Download</a>
+{{- if .Truncated}}
+<br>
+Only the first {{len .Rows}} rows are displayed, the complete data is available as plain text.
+{{- end}}
+{{- if .TruncatedColumns}}
+<br>
+Only the first {{len .Header}} columns are displayed, the complete data is available as plain text.
+{{- end}}
+{{- if .Broken}}
+<br>
+The file could not be parsed after the displayed rows, the complete data is available as plain text.
+{{- end}}
+{{- if .Fd.Description}}
+<br>
+<strong>Description:</strong> {{.Fd.Description}}
+{{- end}}
+<script>
+(function() {
+	var collator = new Intl.Collator(undefined, {numeric: true, sensitivity: "base"});
+	var headers = document.querySelectorAll("thead th");
+	var tbody = document.querySelector("tbody");
+
+	function value(row, i) {
+		return row.cells[i] ? row.cells[i].textContent : "";
+	}
+
+	function compare(a, b) {
+		if (a !== "" && b !== "" && isFinite(a) && isFinite(b)) {
+			return Number(a) - Number(b);
+		}
+		return collator.compare(a, b);
+	}
+
+	headers.forEach(function(th, i) {
+		th.addEventListener("click", function() {
+			var asc = th.getAttribute("data-sort") !== "asc";
+			headers.forEach(function(h) {
+				h.removeAttribute("data-sort");
+			});
+			th.setAttribute("data-sort", asc ? "asc" : "desc");
+
+			var rows = Array.prototype.slice.call(tbody.rows);
+			rows.sort(function(a, b) {
+				var rv = compare(value(a, i), value(b, i));
+				return asc ? rv : -rv;
+			});
+			rows.forEach(function(row) {
+				tbody.appendChild(row);
+			});
+		});
+	});
+})();
+</script>
+</body>
+</html>
+`))
+)
+
+type CsvRenderer struct{}
+
+func (h *CsvRenderer) Name() string {
+	return "csv"
+}
+
+func (h *CsvRenderer) Supports(mimetype string) bool {
+	return mimetypes[mimetype]
+}
+
+// countDelimiters returns the number of delimiters found in each of the
+// first records of the sample, ignoring quoted values.
+func countDelimiters(sample []byte, d rune) []int {
+	rv := []int{}
+	count := 0
+	quoted := false
+	for _, c := range string(sample) {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == d:
+			count++
+		case c == '\n':
+			rv = append(rv, count)
+			if len(rv) == sampleRows {
+				return rv
+			}
+			count = 0
+		}
+	}
+
+	// the last record may be incomplete
+	if len(rv) == 0 {
+		rv = append(rv, count)
+	}
+	return rv
+}
+
+// score returns the number of delimiters per record, if the same in every
+// record of the sample.
+func score(sample []byte, d rune) int {
+	counts := countDelimiters(sample, d)
+	for _, c := range counts[1:] {
+		if c != counts[0] {
+			return 0
+		}
+	}
+	return counts[0]
+}
+
+// detectDelimiter picks the delimiter found the same number of times in
+// every record of the sample, preferring the delimiter found most often and
+// then the fallback.
+func detectDelimiter(sample []byte, fallback int) int {
+	rv := fallback
+	best := score(sample, delimiters[fallback].r)
+	for i, d := range delimiters {
+		if s := score(sample, d.r); s > best {
+			rv = i
+			best = s
+		}
+	}
+	return rv
+}
+
+func (h *CsvRenderer) Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
+	fp, err := fd.Read(r.Context())
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	br := bufio.NewReaderSize(io.LimitReader(fp, maxBytes), sampleSize)
+	sample, _ := br.Peek(sampleSize)
+	if bytes.HasPrefix(sample, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+		sample = sample[3:]
+	}
+
+	fallback := 0
+	if fd.Mimetype == "text/tab-separated-values" {
+		fallback = 1
+	}
+	delimiter := delimiters[detectDelimiter(sample, fallback)]
+
+	cr := csv.NewReader(br)
+	cr.Comma = delimiter.r
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	header := []string{}
+	rows := [][]string{}
+	truncated := false
+	truncatedColumns := false
+	broken := false
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			// the last record read may be incomplete
+			if fd.Size > maxBytes && len(rows) > 0 {
+				rows = rows[:len(rows)-1]
+				truncated = true
+			}
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return err
+			}
+			if fd.Size > maxBytes {
+				truncated = true
+				break
+			}
+			log.Printf("error: csv: %s: %s", fd.GetId(), err)
+			broken = true
+			break
+		}
+
+		// the header is not counted
+		if len(rows) == maxRows+1 {
+			truncated = true
+			break
+		}
+
+		if len(record) > maxColumns {
+			record = record[:maxColumns]
+			truncatedColumns = true
+		}
+		if len(record) > len(header) {
+			header = append(header, make([]string, len(record)-len(header))...)
+		}
+		rows = append(rows, record)
+	}
+
+	// the first row is the header, and rows must have the same number of
+	// cells to be sortable
+	if len(rows) > 0 {
+		copy(header, rows[0])
+		rows = rows[1:]
+	}
+	for i, row := range rows {
+		if len(row) < len(header) {
+			rows[i] = append(row, make([]string, len(header)-len(row))...)
+		}
+	}
+
+	d := struct {
+		Fd               *filedata.FileData
+		Delimiter        string
+		Header           []string
+		Rows             [][]string
+		Truncated        bool
+		TruncatedColumns bool
+		Broken           bool
+		Timestamp        string
+	}{
+		Fd:               fd,
+		Delimiter:        delimiter.name,
+		Header:           header,
+		Rows:             rows,
+		Truncated:        truncated,
+		TruncatedColumns: truncatedColumns,
+		Broken:           broken,
+		Timestamp:        fd.Timestamp.Format("02-01-2006 15:04:05"),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	return tmplCsv.Execute(w, d)
+}
@@ -0,0 +1,62 @@
+package csv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCountDelimiters(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		sample   string
+		d        rune
+		expected []int
+	}{
+		{"empty", "", ',', []int{0}},
+		{"single incomplete", "a,b,c", ',', []int{2}},
+		{"records", "a,b,c\n1,2,3\n", ',', []int{2, 2}},
+		{"incomplete last", "a,b,c\n1,2,3\n4,5", ',', []int{2, 2}},
+		{"other delimiter", "a;b,c\n1;2,3\n", ';', []int{1, 1}},
+		{"tab", "a\tb\n1\t2\n", '\t', []int{1, 1}},
+		{"quoted", "a,\"b,c\"\n1,2\n", ',', []int{1, 1}},
+		{"quoted newline", "a,\"b\nc\"\n1,2\n", ',', []int{1, 1}},
+		{"escaped quote", "a,\"b\"\",c\"\n1,2\n", ',', []int{1, 1}},
+		{"uneven", "a,b\n1,2,3\n\n", ',', []int{1, 2, 0}},
+		{"max rows", strings.Repeat("a,b\n", sampleRows+5), ',', []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countDelimiters([]byte(tt.sample), tt.d); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDetectDelimiter(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		sample   string
+		fallback int
+		expected rune
+	}{
+		{"empty", "", 0, ','},
+		{"empty tsv", "", 1, '\t'},
+		{"comma", "a,b,c\n1,2,3\n", 0, ','},
+		{"tab", "a\tb\tc\n1\t2\t3\n", 0, '\t'},
+		{"semicolon", "a;b;c\n1;2,5;3\n", 0, ';'},
+		{"pipe", "a|b\n1|2\n", 0, '|'},
+		{"single column", "a\n1\n2\n", 1, '\t'},
+		{"inconsistent", "a,b\n1,2,3\n", 0, ','},
+		{"inconsistent tsv", "a,b\n1,2,3\n", 1, '\t'},
+		{"most frequent", "a;b,c,d\n1;2,3,4\n", 0, ','},
+		{"prefer fallback on tie", "a;b\tc\n1;2\t3\n", 1, '\t'},
+		{"quoted delimiters", "a;\"b,c,d\"\n1;\"2,3\"\n", 0, ';'},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := delimiters[detectDelimiter([]byte(tt.sample), tt.fallback)].r; got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
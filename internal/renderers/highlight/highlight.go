@@ -10,6 +10,10 @@ import (
 
 type HighlightRenderer struct{}
 
+func (h *HighlightRenderer) Name() string {
+	return "highlight"
+}
+
 func (h *HighlightRenderer) Supports(mimetype string) bool {
 	lexer, err := highlight.GetLexer(mimetype)
 	if err != nil {
@@ -24,5 +28,5 @@ func (h *HighlightRenderer) Supports(mimetype string) bool {
 }
 
 func (h *HighlightRenderer) Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
-	return highlightFile(w, fd)
+	return highlightFile(w, r, fd)
 }
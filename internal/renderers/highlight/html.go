@@ -17,13 +17,20 @@ var (
 		`<strong>File:</strong> {{.Fd.GetFilename}} |
 <strong>Language:</strong> {{.Lexer}} |
 <strong>Created on:</strong> {{.Timestamp}} |
-<a href="/{{.Fd.GetId}}.txt">Plain text</a> |
-<a href="/{{.Fd.GetId}}/download">Download</a>
+{{- if .Fd.Tags}}
+<strong>Tags:</strong>{{range .Fd.Tags}} <a href="/list?tag={{.}}">{{.}}</a>{{end}} |
+{{- end}}
+<a href="{{.Fd.TextPath}}">Plain text</a> |
+<a href="{{.Fd.DownloadPath}}">Download</a>
+{{- if .Fd.Description}}
+<br>
+<strong>Description:</strong> {{.Fd.Description}}
+{{- end}}
 <br>
 `))
 )
 
-func highlightFile(w http.ResponseWriter, fd *filedata.FileData) error {
+func highlightFile(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
 	lexer, err := highlight.GetLexer(fd.Mimetype)
 	if err != nil {
 		return err
@@ -58,7 +65,7 @@ func highlightFile(w http.ResponseWriter, fd *filedata.FileData) error {
 		return err
 	}
 
-	fp, err := fd.Read()
+	fp, err := fd.Read(r.Context())
 	if err != nil {
 		return err
 	}
@@ -8,6 +8,10 @@ import (
 
 type HtmlRenderer struct{}
 
+func (h *HtmlRenderer) Name() string {
+	return "html"
+}
+
 func (h *HtmlRenderer) Supports(mimetype string) bool {
 	return mimetype == "application/xhtml+xml" || mimetype == "text/html"
 }
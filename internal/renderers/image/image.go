@@ -0,0 +1,89 @@
+package image
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+var (
+	tmplImage = template.Must(template.New("image").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+<title>filebin — {{.Fd.GetFilename}}</title>
+<style type="text/css">
+body { margin: 0; background-color: #222; color: #ddd; font-family: sans-serif; }
+a { color: #8cf; }
+.image { display: flex; align-items: center; justify-content: center; min-height: 80vh; padding: 1em; box-sizing: border-box; }
+.image img { max-width: 100%; max-height: 80vh; }
+.details { padding: 0 1em 1em 1em; }
+</style>
+</head>
+<body>
+<div class="image">
+<a href="{{.Fd.RawPath}}"><img src="{{.Fd.RawPath}}" alt="{{.Fd.GetFilename}}"></a>
+</div>
+<div class="details">
+<strong>File:</strong> {{.Fd.GetFilename}} |
+{{- if .Dimensions}}
+<strong>Dimensions:</strong> {{.Dimensions}} |
+{{- end}}
+<strong>Size:</strong> {{.Size}} |
+<strong>Created on:</strong> {{.Timestamp}} |
+{{- if .Fd.Tags}}
+<strong>Tags:</strong>{{range .Fd.Tags}} <a href="/list?tag={{.}}">{{.}}</a>{{end}} |
+{{- end}}
+<a href="{{.Fd.RawPath}}">Original</a> |
+<a href="{{.Fd.DownloadPath}}">Download</a>
+{{- if .Fd.Description}}
+<br>
+<strong>Description:</strong> {{.Fd.Description}}
+{{- end}}
+</div>
+</body>
+</html>
+`))
+)
+
+type ImageRenderer struct{}
+
+func (h *ImageRenderer) Name() string {
+	return "image"
+}
+
+func (h *ImageRenderer) Supports(mimetype string) bool {
+	return filedata.SupportsThumbnail(mimetype)
+}
+
+func (h *ImageRenderer) Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
+	// the page is still useful without the dimensions, e.g. for images
+	// that can be displayed by browsers but not decoded here
+	dimensions := ""
+	if width, height, err := fd.ImageSize(r.Context()); err == nil {
+		dimensions = fmt.Sprintf("%dx%d", width, height)
+	} else {
+		log.Printf("error: image: %s: %s", fd.GetId(), err)
+	}
+
+	d := struct {
+		Fd         *filedata.FileData
+		Dimensions string
+		Size       string
+		Timestamp  string
+	}{
+		Fd:         fd,
+		Dimensions: dimensions,
+		Size:       utils.FormatSize(fd.Size),
+		Timestamp:  fd.Timestamp.Format("02-01-2006 15:04:05"),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	return tmplImage.Execute(w, d)
+}
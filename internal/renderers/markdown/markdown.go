@@ -14,12 +14,16 @@ import (
 
 type MarkdownRenderer struct{}
 
+func (h *MarkdownRenderer) Name() string {
+	return "markdown"
+}
+
 func (h *MarkdownRenderer) Supports(mimetype string) bool {
 	return mimetype == "text/x-markdown"
 }
 
 func (h *MarkdownRenderer) Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
-	f, err := fd.Read()
+	f, err := fd.Read(r.Context())
 	if err != nil {
 		return err
 	}
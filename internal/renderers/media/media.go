@@ -0,0 +1,113 @@
+package media
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+var (
+	tmplMedia = template.Must(template.New("media").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+<title>filebin — {{.Fd.GetFilename}}</title>
+{{- if .BaseUrl}}
+<meta property="og:title" content="{{.Fd.GetFilename}}">
+<meta property="og:url" content="{{.BaseUrl}}{{.Fd.Path}}">
+{{- if .Video}}
+<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.BaseUrl}}{{.Fd.RawPath}}">
+<meta property="og:video:type" content="{{.Fd.Mimetype}}">
+{{- else}}
+<meta property="og:type" content="music.song">
+<meta property="og:audio" content="{{.BaseUrl}}{{.Fd.RawPath}}">
+<meta property="og:audio:type" content="{{.Fd.Mimetype}}">
+{{- end}}
+{{- if .Fd.Description}}
+<meta property="og:description" content="{{.Fd.Description}}">
+{{- end}}
+{{- end}}
+<style type="text/css">
+body { margin: 0; background-color: #222; color: #ddd; font-family: sans-serif; }
+a { color: #8cf; }
+.player { display: flex; align-items: center; justify-content: center; min-height: {{if .Video}}80vh{{else}}30vh{{end}}; padding: 1em; box-sizing: border-box; }
+.player video { max-width: 100%; max-height: 80vh; }
+.player audio { width: 100%; max-width: 40em; }
+.details { padding: 0 1em 1em 1em; }
+</style>
+</head>
+<body>
+<div class="player">
+{{- if .Video}}
+<video controls preload="metadata">
+{{- else}}
+<audio controls preload="metadata">
+{{- end}}
+<source src="{{.Fd.RawPath}}" type="{{.Fd.Mimetype}}">
+Your browser can't play this file, <a href="{{.Fd.DownloadPath}}">download it</a> instead.
+{{- if .Video}}
+</video>
+{{- else}}
+</audio>
+{{- end}}
+</div>
+<div class="details">
+<strong>File:</strong> {{.Fd.GetFilename}} |
+<strong>Type:</strong> {{.Fd.Mimetype}} |
+<strong>Size:</strong> {{.Size}} |
+<strong>Created on:</strong> {{.Timestamp}} |
+{{- if .Fd.Tags}}
+<strong>Tags:</strong>{{range .Fd.Tags}} <a href="/list?tag={{.}}">{{.}}</a>{{end}} |
+{{- end}}
+<a href="{{.Fd.RawPath}}">Original</a> |
+<a href="{{.Fd.DownloadPath}}">Download</a>
+{{- if .Fd.Description}}
+<br>
+<strong>Description:</strong> {{.Fd.Description}}
+{{- end}}
+</div>
+</body>
+</html>
+`))
+)
+
+type MediaRenderer struct{}
+
+func (h *MediaRenderer) Name() string {
+	return "media"
+}
+
+func (h *MediaRenderer) Supports(mimetype string) bool {
+	return strings.HasPrefix(mimetype, "audio/") || strings.HasPrefix(mimetype, "video/")
+}
+
+func (h *MediaRenderer) Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error {
+	s, err := settings.Get()
+	if err != nil {
+		return err
+	}
+
+	d := struct {
+		Fd        *filedata.FileData
+		BaseUrl   string
+		Video     bool
+		Size      string
+		Timestamp string
+	}{
+		Fd:        fd,
+		BaseUrl:   s.BaseUrl,
+		Video:     strings.HasPrefix(fd.Mimetype, "video/"),
+		Size:      utils.FormatSize(fd.Size),
+		Timestamp: fd.Timestamp.Format("02-01-2006 15:04:05"),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	return tmplMedia.Execute(w, d)
+}
@@ -9,6 +9,10 @@ import (
 
 type RawRenderer struct{}
 
+func (h *RawRenderer) Name() string {
+	return "raw"
+}
+
 func (h *RawRenderer) Supports(mimetype string) bool {
 	return true
 }
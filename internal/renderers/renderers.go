@@ -5,9 +5,13 @@ import (
 	"net/http"
 
 	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/renderers/archive"
+	"github.com/rafaelmartins/filebin/internal/renderers/csv"
 	"github.com/rafaelmartins/filebin/internal/renderers/highlight"
 	"github.com/rafaelmartins/filebin/internal/renderers/html"
+	"github.com/rafaelmartins/filebin/internal/renderers/image"
 	"github.com/rafaelmartins/filebin/internal/renderers/markdown"
+	"github.com/rafaelmartins/filebin/internal/renderers/media"
 	"github.com/rafaelmartins/filebin/internal/renderers/raw"
 )
 
@@ -15,12 +19,17 @@ var (
 	reg = []Renderer{
 		&markdown.MarkdownRenderer{},
 		&html.HtmlRenderer{},
+		&image.ImageRenderer{},
+		&media.MediaRenderer{},
+		&archive.ArchiveRenderer{},
+		&csv.CsvRenderer{},
 		&highlight.HighlightRenderer{},
 		&raw.RawRenderer{},
 	}
 )
 
 type Renderer interface {
+	Name() string
 	Supports(mimetype string) bool
 	Render(w http.ResponseWriter, r *http.Request, fd *filedata.FileData) error
 }
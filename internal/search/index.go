@@ -0,0 +1,238 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+)
+
+const (
+	minTermLength = 2
+	maxTermLength = 64
+
+	// filenames are short, but usually more relevant than the contents
+	filenameWeight = 5
+)
+
+type document struct {
+	fd    *filedata.FileData
+	terms []string
+
+	// the contents are only read again if the file changes. their term
+	// frequencies are the postings minus the frequencies of the metadata
+	// terms, that are way smaller than the contents.
+	size      int64
+	timestamp time.Time
+	meta      map[string]uint32
+}
+
+type index struct {
+	postings map[string]map[string]uint32
+	docs     map[string]*document
+	loaded   map[string]*savedDocument
+	dirty    bool
+	m        sync.RWMutex
+}
+
+type hit struct {
+	fd    *filedata.FileData
+	score float64
+}
+
+func newIndex() *index {
+	return &index{
+		postings: map[string]map[string]uint32{},
+		docs:     map[string]*document{},
+		loaded:   map[string]*savedDocument{},
+	}
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokens calls f with the byte offsets of every term found in s.
+func tokens(s string, f func(start int, end int)) {
+	start := -1
+	for i, r := range s {
+		if isWordChar(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			f(start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		f(start, len(s))
+	}
+}
+
+func normalize(term string) (string, bool) {
+	if utf8.RuneCountInString(term) < minTermLength || len(term) > maxTermLength {
+		return "", false
+	}
+	return strings.ToLower(term), true
+}
+
+func terms(s string, f func(term string)) {
+	tokens(s, func(start int, end int) {
+		if t, ok := normalize(s[start:end]); ok {
+			f(t)
+		}
+	})
+}
+
+// content returns the term frequencies of the contents of a file, if
+// indexed already, or loaded from the saved index and still valid.
+func (i *index) content(fd *filedata.FileData) (map[string]uint32, bool) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	if doc, ok := i.docs[fd.GetId()]; ok && doc.size == fd.Size && doc.timestamp.Equal(fd.Timestamp) {
+		return i.docContent(fd.GetId(), doc), true
+	}
+
+	if doc, ok := i.loaded[fd.GetId()]; ok {
+		delete(i.loaded, fd.GetId())
+		if doc.Size == fd.Size && doc.Timestamp.Equal(fd.Timestamp) && doc.Content != nil {
+			return doc.Content, true
+		}
+	}
+	return nil, false
+}
+
+// docContent returns the term frequencies of the contents of a document. It
+// must be called with the lock held.
+func (i *index) docContent(id string, doc *document) map[string]uint32 {
+	rv := make(map[string]uint32, len(doc.terms))
+	for _, t := range doc.terms {
+		if n := i.postings[t][id] - doc.meta[t]; n > 0 {
+			rv[t] = n
+		}
+	}
+	return rv
+}
+
+// add indexes a file, with the term frequencies of its contents and
+// metadata.
+func (i *index) add(fd *filedata.FileData, content map[string]uint32, meta map[string]uint32) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	i.remove(fd.GetId())
+
+	doc := &document{
+		fd:        fd,
+		terms:     make([]string, 0, len(content)+len(meta)),
+		size:      fd.Size,
+		timestamp: fd.Timestamp,
+		meta:      meta,
+	}
+	posting := func(t string) map[string]uint32 {
+		p, ok := i.postings[t]
+		if !ok {
+			p = map[string]uint32{}
+			i.postings[t] = p
+		}
+		if _, ok := p[fd.GetId()]; !ok {
+			doc.terms = append(doc.terms, t)
+		}
+		return p
+	}
+	for t, n := range content {
+		posting(t)[fd.GetId()] += n
+	}
+	for t, n := range meta {
+		posting(t)[fd.GetId()] += n
+	}
+	i.docs[fd.GetId()] = doc
+	i.dirty = true
+}
+
+// remove must be called with the lock held.
+func (i *index) remove(id string) {
+	doc, ok := i.docs[id]
+	if !ok {
+		return
+	}
+
+	for _, t := range doc.terms {
+		if p, ok := i.postings[t]; ok {
+			delete(p, id)
+			if len(p) == 0 {
+				delete(i.postings, t)
+			}
+		}
+	}
+	delete(i.docs, id)
+	i.dirty = true
+}
+
+func (i *index) delete(id string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	i.remove(id)
+}
+
+// search returns the documents that contain all the terms, best matches
+// first.
+func (i *index) search(qterms []string) []*hit {
+	i.m.RLock()
+	defer i.m.RUnlock()
+
+	if len(qterms) == 0 {
+		return nil
+	}
+
+	postings := make([]map[string]uint32, 0, len(qterms))
+	for _, t := range qterms {
+		p, ok := i.postings[t]
+		if !ok {
+			return nil
+		}
+		postings = append(postings, p)
+	}
+
+	// the rarest term has the smallest list of candidates
+	sort.Slice(postings, func(a int, b int) bool {
+		return len(postings[a]) < len(postings[b])
+	})
+
+	n := float64(len(i.docs))
+	rv := []*hit{}
+
+	for id := range postings[0] {
+		score := 0.0
+		for _, p := range postings {
+			tf, ok := p[id]
+			if !ok {
+				score = -1
+				break
+			}
+			score += (1 + math.Log(float64(tf))) * math.Log(1+n/float64(len(p)))
+		}
+		if score >= 0 {
+			rv = append(rv, &hit{fd: i.docs[id].fd, score: score})
+		}
+	}
+
+	sort.Slice(rv, func(a int, b int) bool {
+		if rv[a].score != rv[b].score {
+			return rv[a].score > rv[b].score
+		}
+		return rv[a].fd.Timestamp.After(rv[b].fd.Timestamp)
+	})
+
+	return rv
+}
@@ -0,0 +1,54 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+)
+
+func TestIndexContent(t *testing.T) {
+	i := newIndex()
+
+	fd := &filedata.FileData{
+		Filename:  "foo.txt",
+		Size:      10,
+		Timestamp: time.Now().UTC(),
+	}
+	i.add(fd, map[string]uint32{"foo": 2, "bar": 1}, map[string]uint32{"foo": filenameWeight, "txt": filenameWeight})
+
+	if hits := i.search([]string{"foo"}); len(hits) != 1 {
+		t.Fatalf("unexpected hits: %d", len(hits))
+	}
+	if p := i.postings["foo"][fd.GetId()]; p != 2+filenameWeight {
+		t.Errorf("unexpected frequency: %d", p)
+	}
+
+	// the contents don't include the metadata terms, so that the file can
+	// be indexed again after metadata updates without reading it
+	content, ok := i.content(fd)
+	if !ok {
+		t.Fatal("content not found")
+	}
+	if len(content) != 2 || content["foo"] != 2 || content["bar"] != 1 {
+		t.Errorf("unexpected content: %v", content)
+	}
+
+	i.add(fd, content, map[string]uint32{"baz": filenameWeight})
+	if hits := i.search([]string{"txt"}); len(hits) != 0 {
+		t.Errorf("unexpected hits for old metadata: %d", len(hits))
+	}
+	if hits := i.search([]string{"baz", "bar"}); len(hits) != 1 {
+		t.Errorf("unexpected hits: %d", len(hits))
+	}
+	if content, _ := i.content(fd); len(content) != 2 || content["foo"] != 2 || content["bar"] != 1 {
+		t.Errorf("unexpected content: %v", content)
+	}
+
+	// changed files are read again
+	fd2 := *fd
+	fd2.Size = 20
+	if _, ok := i.content(&fd2); ok {
+		t.Error("unexpected content for changed file")
+	}
+}
@@ -0,0 +1,119 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	saveInterval = time.Minute
+)
+
+var (
+	indexPath string
+)
+
+// savedDocument only stores the terms found in the contents, the metadata
+// may have changed while filebin was not running.
+type savedDocument struct {
+	Size      int64             `json:"size"`
+	Timestamp time.Time         `json:"timestamp"`
+	Content   map[string]uint32 `json:"content"`
+}
+
+func load(fn string) error {
+	data := map[string]*savedDocument{}
+
+	fp, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+
+	if err := json.NewDecoder(fp).Decode(&data); err != nil {
+		return err
+	}
+
+	idx.m.Lock()
+	defer idx.m.Unlock()
+
+	for id, doc := range data {
+		if doc != nil {
+			idx.loaded[id] = doc
+		}
+	}
+	return nil
+}
+
+func save(fn string) error {
+	idx.m.Lock()
+	if !idx.dirty {
+		idx.m.Unlock()
+		return nil
+	}
+	data := make(map[string]*savedDocument, len(idx.docs))
+	for id, doc := range idx.docs {
+		data[id] = &savedDocument{
+			Size:      doc.size,
+			Timestamp: doc.timestamp,
+			Content:   idx.docContent(id, doc),
+		}
+	}
+	idx.dirty = false
+	idx.m.Unlock()
+
+	// the previous file is replaced atomically, to not lose everything if
+	// filebin is killed while writing.
+	fp, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fp).Encode(data)
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+
+		idx.m.Lock()
+		idx.dirty = true
+		idx.m.Unlock()
+		return err
+	}
+	return nil
+}
+
+func saveLoop(ctx context.Context, fn string) {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := save(fn); err != nil {
+				log.Printf("error: search: %s", err)
+			}
+		}
+	}
+}
+
+// Close saves the index, if enabled.
+func Close() error {
+	if idx == nil || indexPath == "" {
+		return nil
+	}
+	return save(indexPath)
+}
@@ -0,0 +1,244 @@
+package search
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/highlight"
+	"github.com/rafaelmartins/filebin/internal/settings"
+)
+
+const (
+	// only the beginning of huge files is indexed
+	maxIndexedSize = 16 * 1024 * 1024
+)
+
+var (
+	ErrDisabled = errors.New("search: disabled")
+
+	idx *index
+	q   = &queue{notify: make(chan struct{}, 1)}
+)
+
+type Result struct {
+	File     *filedata.FileData `json:"-"`
+	Score    float64            `json:"score"`
+	Snippets []*Snippet         `json:"snippets"`
+}
+
+type op struct {
+	delete bool
+	fd     *filedata.FileData
+}
+
+// queue is unbounded, because event listeners must not block.
+type queue struct {
+	data   []*op
+	notify chan struct{}
+	m      sync.Mutex
+}
+
+func (q *queue) push(o *op) {
+	q.m.Lock()
+	q.data = append(q.data, o)
+	q.m.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) pop() []*op {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	rv := q.data
+	q.data = nil
+	return rv
+}
+
+func Init(ctx context.Context) error {
+	s, err := settings.Get()
+	if err != nil {
+		return err
+	}
+
+	if !s.SearchEnabled {
+		return nil
+	}
+
+	idx = newIndex()
+
+	if s.SearchIndexFile != "" {
+		if err := load(s.SearchIndexFile); err != nil {
+			return err
+		}
+		indexPath = s.SearchIndexFile
+		go saveLoop(ctx, s.SearchIndexFile)
+	}
+
+	filedata.Subscribe(func(e *filedata.Event) {
+		q.push(&op{
+			delete: e.Removed(),
+			fd:     e.File,
+		})
+	})
+
+	// files deleted in the meantime are skipped by the worker
+	filedata.ForEach(func(fd *filedata.FileData) {
+		q.push(&op{fd: fd})
+	})
+
+	go worker(ctx)
+	return nil
+}
+
+func worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.notify:
+		}
+
+		for _, o := range q.pop() {
+			if o.delete {
+				idx.delete(o.fd.GetId())
+				continue
+			}
+
+			if !o.fd.Registered() {
+				continue
+			}
+
+			if err := indexFile(ctx, o.fd); err != nil {
+				log.Printf("error: search: %s: %s", o.fd.GetId(), err)
+			}
+		}
+
+		// every registered file was queued before starting the worker,
+		// what was not used from the saved index is stale.
+		idx.m.Lock()
+		idx.loaded = map[string]*savedDocument{}
+		idx.m.Unlock()
+	}
+}
+
+func readContent(ctx context.Context, fd *filedata.FileData) (map[string]uint32, error) {
+	rv := map[string]uint32{}
+	if _, err := highlight.GetLexer(fd.Mimetype); err != nil {
+		return rv, nil
+	}
+
+	fp, err := fd.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	r := bufio.NewReader(io.LimitReader(fp, maxIndexedSize))
+	for {
+		line, err := r.ReadString('\n')
+		terms(line, func(t string) {
+			rv[t]++
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+func indexFile(ctx context.Context, fd *filedata.FileData) error {
+	content, ok := idx.content(fd)
+	if !ok {
+		var err error
+		content, err = readContent(ctx, fd)
+		if err != nil {
+			return err
+		}
+	}
+
+	meta := map[string]uint32{}
+	terms(fd.Filename, func(t string) {
+		meta[t] += filenameWeight
+	})
+	terms(fd.Description, func(t string) {
+		meta[t] += filenameWeight
+	})
+	for _, tag := range fd.Tags {
+		terms(tag, func(t string) {
+			meta[t] += filenameWeight
+		})
+	}
+
+	idx.add(fd, content, meta)
+	return nil
+}
+
+func Enabled() bool {
+	return idx != nil
+}
+
+func readSnippets(ctx context.Context, fd *filedata.FileData, qterms map[string]bool) ([]*Snippet, error) {
+	fp, err := fd.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return snippets(io.LimitReader(fp, maxIndexedSize), qterms)
+}
+
+// Search returns up to limit files that contain all the terms in the query,
+// best matches first.
+func Search(ctx context.Context, query string, limit int) ([]*Result, error) {
+	if idx == nil {
+		return nil, ErrDisabled
+	}
+
+	qterms := []string{}
+	seen := map[string]bool{}
+	terms(query, func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			qterms = append(qterms, t)
+		}
+	})
+
+	hits := idx.search(qterms)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	rv := []*Result{}
+	for _, h := range hits {
+		r := &Result{
+			File:     h.fd,
+			Score:    h.score,
+			Snippets: []*Snippet{},
+		}
+
+		if _, err := highlight.GetLexer(h.fd.Mimetype); err == nil {
+			// the file may have been deleted after the search
+			if sn, err := readSnippets(ctx, h.fd, seen); err == nil {
+				r.Snippets = sn
+			} else {
+				log.Printf("error: search: %s: %s", h.fd.GetId(), err)
+			}
+		}
+
+		rv = append(rv, r)
+	}
+
+	return rv, nil
+}
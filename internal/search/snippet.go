@@ -0,0 +1,109 @@
+package search
+
+import (
+	"bufio"
+	"html/template"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxSnippets      = 3
+	maxSnippetLength = 240
+	maxLineLength    = 1024 * 1024
+)
+
+type Snippet struct {
+	Line int           `json:"line"`
+	Html template.HTML `json:"html"`
+}
+
+// window returns the part of a long line around the first match.
+func window(line string, first int) (string, bool, bool) {
+	if len(line) <= maxSnippetLength {
+		return line, false, false
+	}
+
+	start := first - maxSnippetLength/3
+	if start < 0 {
+		start = 0
+	}
+	end := start + maxSnippetLength
+	if end > len(line) {
+		end = len(line)
+		start = end - maxSnippetLength
+	}
+
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start--
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end++
+	}
+
+	return line[start:end], start > 0, end < len(line)
+}
+
+func markLine(line string, qterms map[string]bool) (template.HTML, bool) {
+	first := -1
+	tokens(line, func(start int, end int) {
+		if t, ok := normalize(line[start:end]); first < 0 && ok && qterms[t] {
+			first = start
+		}
+	})
+	if first < 0 {
+		return "", false
+	}
+
+	line, before, after := window(line, first)
+
+	var b strings.Builder
+	if before {
+		b.WriteString("…")
+	}
+
+	last := 0
+	tokens(line, func(start int, end int) {
+		if t, ok := normalize(line[start:end]); ok && qterms[t] {
+			b.WriteString(template.HTMLEscapeString(line[last:start]))
+			b.WriteString("<mark>")
+			b.WriteString(template.HTMLEscapeString(line[start:end]))
+			b.WriteString("</mark>")
+			last = end
+		}
+	})
+	b.WriteString(template.HTMLEscapeString(line[last:]))
+
+	if after {
+		b.WriteString("…")
+	}
+
+	return template.HTML(b.String()), true
+}
+
+// snippets returns the first lines of r that contain any of the terms, with
+// the terms highlighted.
+func snippets(r io.Reader, qterms map[string]bool) ([]*Snippet, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+
+	rv := []*Snippet{}
+	for i := 1; s.Scan(); i++ {
+		if h, ok := markLine(strings.TrimRight(s.Text(), "\r"), qterms); ok {
+			rv = append(rv, &Snippet{
+				Line: i,
+				Html: h,
+			})
+			if len(rv) == maxSnippets {
+				break
+			}
+		}
+	}
+
+	// snippets are best effort, no need to fail for very long lines
+	if err := s.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, err
+	}
+	return rv, nil
+}
@@ -1,14 +1,20 @@
 package settings
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/azure"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/gcs"
 	"github.com/rafaelmartins/filebin/internal/filedata/backends/s3"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends/sftp"
 )
 
 var (
@@ -26,8 +32,36 @@ type Settings struct {
 	UploadMaxSizeMb uint
 	IndexFooter     string
 
-	S3Options  s3.S3Options
-	StorageDir string
+	S3Options     s3.S3Options
+	AzureOptions  azure.AzureOptions
+	GCSOptions    gcs.GCSOptions
+	SFTPOptions   sftp.SFTPOptions
+	StorageDir    string
+	StorageMemory bool
+
+	CacheDir       string
+	CacheMaxSizeMb uint
+
+	BackendTimeoutMetadata time.Duration
+	BackendTimeoutRead     time.Duration
+	BackendTimeoutWrite    time.Duration
+	BackendTimeoutServe    time.Duration
+
+	ReconcileInterval time.Duration
+
+	SearchEnabled   bool
+	SearchIndexFile string
+
+	AccessStatsFile         string
+	AccessStatsSaveInterval time.Duration
+	AccessStatsReferrers    bool
+
+	WebhookUrls        []string
+	WebhookSecret      string
+	WebhookEvents      []string
+	WebhookOutboxDir   string
+	WebhookMaxAttempts uint
+	WebhookTimeout     time.Duration
 
 	Backend backends.Backend
 }
@@ -72,6 +106,253 @@ func getBool(key string, def bool) (bool, error) {
 	return v2, nil
 }
 
+// GetS3Options parses just the S3 settings, for commands that don't need the
+// full server configuration.
+func GetS3Options() (s3.S3Options, error) {
+	var err error
+	o := s3.S3Options{}
+
+	o.AccessKeyId, err = getString("FILEBIN_S3_ACCESS_KEY_ID", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.SecretAccessKey, err = getString("FILEBIN_S3_SECRET_ACCESS_KEY", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Endpoint, err = getString("FILEBIN_S3_ENDPOINT", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Region, err = getString("FILEBIN_S3_REGION", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Bucket, err = getString("FILEBIN_S3_BUCKET", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Prefix, err = getString("FILEBIN_S3_PREFIX", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	s3PresignExpireMinutes, err := getUint("FILEBIN_S3_PRESIGN_EXPIRE_MINUTES", 5, true, 10, 0)
+	if err != nil {
+		return o, err
+	}
+	o.PresignExpire = time.Duration(s3PresignExpireMinutes) * time.Minute
+
+	o.ProxyData, err = getBool("FILEBIN_S3_PROXY_DATA", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.ForcePathStyle, err = getBool("FILEBIN_S3_FORCE_PATH_STYLE", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.SslInsecure, err = getBool("FILEBIN_S3_SSL_INSECURE", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.SslCertificate, err = getString("FILEBIN_S3_SSL_CERTIFICATE", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	s3UploadPartSizeMb, err := getUint("FILEBIN_S3_UPLOAD_PART_SIZE_MB", 5, true, 10, 0)
+	if err != nil {
+		return o, err
+	}
+	if s3UploadPartSizeMb < 5 {
+		return o, errors.New("FILEBIN_S3_UPLOAD_PART_SIZE_MB must be >= 5")
+	}
+	o.UploadPartSize = int64(s3UploadPartSizeMb) * 1024 * 1024
+
+	s3UploadParallel, err := getUint("FILEBIN_S3_UPLOAD_PARALLEL", 5, true, 10, 0)
+	if err != nil {
+		return o, err
+	}
+	o.UploadParallel = int(s3UploadParallel)
+
+	o.ServerSideEncryption, err = getString("FILEBIN_S3_SSE", "", false)
+	if err != nil {
+		return o, err
+	}
+	switch o.ServerSideEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return o, errors.New("FILEBIN_S3_SSE must be one of: AES256, aws:kms")
+	}
+
+	o.SSEKMSKeyId, err = getString("FILEBIN_S3_SSE_KMS_KEY_ID", "", false)
+	if err != nil {
+		return o, err
+	}
+	if o.SSEKMSKeyId != "" && o.ServerSideEncryption != "aws:kms" {
+		return o, errors.New("FILEBIN_S3_SSE_KMS_KEY_ID requires FILEBIN_S3_SSE=aws:kms")
+	}
+
+	s3SSECustomerKey, err := getString("FILEBIN_S3_SSE_CUSTOMER_KEY", "", false)
+	if err != nil {
+		return o, err
+	}
+	if s3SSECustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(s3SSECustomerKey)
+		if err != nil {
+			return o, fmt.Errorf("FILEBIN_S3_SSE_CUSTOMER_KEY: %w", err)
+		}
+		if len(key) != 32 {
+			return o, errors.New("FILEBIN_S3_SSE_CUSTOMER_KEY must be a base64-encoded 256-bit key")
+		}
+		o.SSECustomerKey = string(key)
+	}
+
+	o.StorageClass, err = getString("FILEBIN_S3_STORAGE_CLASS", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	return o, nil
+}
+
+// GetAzureOptions parses just the Azure settings, for commands that don't
+// need the full server configuration.
+func GetAzureOptions() (azure.AzureOptions, error) {
+	var err error
+	o := azure.AzureOptions{}
+
+	o.AccountName, err = getString("FILEBIN_AZURE_ACCOUNT_NAME", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.AccountKey, err = getString("FILEBIN_AZURE_ACCOUNT_KEY", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Endpoint, err = getString("FILEBIN_AZURE_ENDPOINT", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Container, err = getString("FILEBIN_AZURE_CONTAINER", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	azureSASExpireMinutes, err := getUint("FILEBIN_AZURE_SAS_EXPIRE_MINUTES", 5, true, 10, 0)
+	if err != nil {
+		return o, err
+	}
+	o.SASExpire = time.Duration(azureSASExpireMinutes) * time.Minute
+
+	o.ProxyData, err = getBool("FILEBIN_AZURE_PROXY_DATA", false)
+	if err != nil {
+		return o, err
+	}
+
+	return o, nil
+}
+
+// GetGCSOptions parses just the GCS settings, for commands that don't need
+// the full server configuration.
+func GetGCSOptions() (gcs.GCSOptions, error) {
+	var err error
+	o := gcs.GCSOptions{}
+
+	o.CredentialsFile, err = getString("FILEBIN_GCS_CREDENTIALS_FILE", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Endpoint, err = getString("FILEBIN_GCS_ENDPOINT", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Bucket, err = getString("FILEBIN_GCS_BUCKET", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Prefix, err = getString("FILEBIN_GCS_PREFIX", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	gcsSignedUrlExpireMinutes, err := getUint("FILEBIN_GCS_SIGNED_URL_EXPIRE_MINUTES", 5, true, 10, 0)
+	if err != nil {
+		return o, err
+	}
+	o.SignedUrlExpire = time.Duration(gcsSignedUrlExpireMinutes) * time.Minute
+
+	o.ProxyData, err = getBool("FILEBIN_GCS_PROXY_DATA", false)
+	if err != nil {
+		return o, err
+	}
+
+	return o, nil
+}
+
+// GetSFTPOptions parses just the SFTP settings, for commands that don't need
+// the full server configuration.
+func GetSFTPOptions() (sftp.SFTPOptions, error) {
+	var err error
+	o := sftp.SFTPOptions{}
+
+	o.Host, err = getString("FILEBIN_SFTP_HOST", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Username, err = getString("FILEBIN_SFTP_USERNAME", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Password, err = getString("FILEBIN_SFTP_PASSWORD", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.PrivateKeyFile, err = getString("FILEBIN_SFTP_PRIVATE_KEY_FILE", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.PrivateKeyPassphrase, err = getString("FILEBIN_SFTP_PRIVATE_KEY_PASSPHRASE", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.KnownHostsFile, err = getString("FILEBIN_SFTP_KNOWN_HOSTS_FILE", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.InsecureIgnoreHostKey, err = getBool("FILEBIN_SFTP_INSECURE_IGNORE_HOST_KEY", false)
+	if err != nil {
+		return o, err
+	}
+
+	o.Dir, err = getString("FILEBIN_SFTP_DIR", "", false)
+	if err != nil {
+		return o, err
+	}
+
+	return o, nil
+}
+
 func Get() (*Settings, error) {
 	if settings != nil {
 		return settings, nil
@@ -119,61 +400,161 @@ func Get() (*Settings, error) {
 		return nil, err
 	}
 
-	s.S3Options.AccessKeyId, err = getString("FILEBIN_S3_ACCESS_KEY_ID", "", false)
+	s.S3Options, err = GetS3Options()
 	if err != nil {
 		return nil, err
 	}
 
-	s.S3Options.SecretAccessKey, err = getString("FILEBIN_S3_SECRET_ACCESS_KEY", "", false)
+	s.AzureOptions, err = GetAzureOptions()
 	if err != nil {
 		return nil, err
 	}
 
-	s.S3Options.Endpoint, err = getString("FILEBIN_S3_ENDPOINT", "", false)
+	s.GCSOptions, err = GetGCSOptions()
 	if err != nil {
 		return nil, err
 	}
 
-	s.S3Options.Region, err = getString("FILEBIN_S3_REGION", "", false)
+	s.SFTPOptions, err = GetSFTPOptions()
 	if err != nil {
 		return nil, err
 	}
 
-	s.S3Options.Bucket, err = getString("FILEBIN_S3_BUCKET", "", false)
+	s.StorageDir, err = getString("FILEBIN_STORAGE_DIR", "", false)
 	if err != nil {
 		return nil, err
 	}
 
-	s3PresignExpireMinutes, err := getUint("FILEBIN_S3_PRESIGN_EXPIRE_MINUTES", 5, true, 10, 0)
+	s.StorageMemory, err = getBool("FILEBIN_STORAGE_MEMORY", false)
 	if err != nil {
 		return nil, err
 	}
-	s.S3Options.PresignExpire = time.Duration(s3PresignExpireMinutes) * time.Minute
 
-	s.S3Options.ProxyData, err = getBool("FILEBIN_S3_PROXY_DATA", false)
+	s.CacheDir, err = getString("FILEBIN_CACHE_DIR", "", false)
 	if err != nil {
 		return nil, err
 	}
 
-	s.S3Options.ForcePathStyle, err = getBool("FILEBIN_S3_FORCE_PATH_STYLE", false)
+	cacheMaxSizeMb, err := getUint("FILEBIN_CACHE_MAX_SIZE_MB", 1024, true, 10, 0)
 	if err != nil {
 		return nil, err
 	}
+	if cacheMaxSizeMb == 0 {
+		return nil, errors.New("FILEBIN_CACHE_MAX_SIZE_MB must be > 0")
+	}
+	s.CacheMaxSizeMb = uint(cacheMaxSizeMb)
 
-	s.S3Options.SslInsecure, err = getBool("FILEBIN_S3_SSL_INSECURE", false)
+	// timeouts are disabled by default
+	backendTimeoutMetadata, err := getUint("FILEBIN_BACKEND_TIMEOUT_METADATA_SECONDS", 0, false, 10, 0)
 	if err != nil {
 		return nil, err
 	}
+	s.BackendTimeoutMetadata = time.Duration(backendTimeoutMetadata) * time.Second
 
-	s.S3Options.SslCertificate, err = getString("FILEBIN_S3_SSL_CERTIFICATE", "", false)
+	backendTimeoutRead, err := getUint("FILEBIN_BACKEND_TIMEOUT_READ_SECONDS", 0, false, 10, 0)
 	if err != nil {
 		return nil, err
 	}
+	s.BackendTimeoutRead = time.Duration(backendTimeoutRead) * time.Second
 
-	s.StorageDir, err = getString("FILEBIN_STORAGE_DIR", "", false)
+	backendTimeoutWrite, err := getUint("FILEBIN_BACKEND_TIMEOUT_WRITE_SECONDS", 0, false, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.BackendTimeoutWrite = time.Duration(backendTimeoutWrite) * time.Second
+
+	backendTimeoutServe, err := getUint("FILEBIN_BACKEND_TIMEOUT_SERVE_SECONDS", 0, false, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.BackendTimeoutServe = time.Duration(backendTimeoutServe) * time.Second
+
+	// only useful when multiple instances share the same backend
+	reconcileInterval, err := getUint("FILEBIN_RECONCILE_INTERVAL_SECONDS", 0, false, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.ReconcileInterval = time.Duration(reconcileInterval) * time.Second
+
+	s.SearchEnabled, err = getBool("FILEBIN_SEARCH_ENABLED", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a saved index, every text file is read again on startup
+	s.SearchIndexFile, err = getString("FILEBIN_SEARCH_INDEX_FILE", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	s.AccessStatsFile, err = getString("FILEBIN_ACCESS_STATS_FILE", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	accessStatsSaveInterval, err := getUint("FILEBIN_ACCESS_STATS_SAVE_INTERVAL_SECONDS", 60, true, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.AccessStatsSaveInterval = time.Duration(accessStatsSaveInterval) * time.Second
+
+	s.AccessStatsReferrers, err = getBool("FILEBIN_ACCESS_STATS_REFERRERS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookUrls, err := getString("FILEBIN_WEBHOOK_URLS", "", false)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range strings.FieldsFunc(webhookUrls, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("FILEBIN_WEBHOOK_URLS: invalid url: %s", v)
+		}
+		s.WebhookUrls = append(s.WebhookUrls, v)
+	}
+
+	// receivers must be able to verify that the requests came from filebin
+	s.WebhookSecret, err = getString("FILEBIN_WEBHOOK_SECRET", "", len(s.WebhookUrls) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookEvents, err := getString("FILEBIN_WEBHOOK_EVENTS", "upload,delete,expire", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range strings.FieldsFunc(webhookEvents, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		switch v {
+		case "upload", "update", "delete", "expire":
+			s.WebhookEvents = append(s.WebhookEvents, v)
+		default:
+			return nil, fmt.Errorf("FILEBIN_WEBHOOK_EVENTS: invalid event: %s", v)
+		}
+	}
+
+	// deliveries must not be lost on restarts
+	s.WebhookOutboxDir, err = getString("FILEBIN_WEBHOOK_OUTBOX_DIR", "", len(s.WebhookUrls) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookMaxAttempts, err := getUint("FILEBIN_WEBHOOK_MAX_ATTEMPTS", 10, true, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.WebhookMaxAttempts = uint(webhookMaxAttempts)
+
+	webhookTimeout, err := getUint("FILEBIN_WEBHOOK_TIMEOUT_SECONDS", 10, true, 10, 0)
 	if err != nil {
 		return nil, err
 	}
+	s.WebhookTimeout = time.Duration(webhookTimeout) * time.Second
 
 	s.IndexFooter, err = getString("FILEBIN_INDEX_FOOTER", "", false)
 	if err != nil {
@@ -189,7 +570,7 @@ func Get() (*Settings, error) {
 	}
 	s.UploadMaxSizeMb = uint(uploadMaxSizeMb)
 
-	s.Backend, err = backends.Lookup(s.StorageDir, s.S3Options)
+	s.Backend, err = backends.Lookup(s.StorageMemory, s.StorageDir, s.S3Options, s.AzureOptions, s.GCSOptions, s.SFTPOptions, s.CacheDir, int64(s.CacheMaxSizeMb)*1024*1024)
 	if err != nil {
 		return nil, err
 	}
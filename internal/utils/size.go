@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"fmt"
+)
+
+// FormatSize formats a size in bytes using binary units, e.g. "1.5 MiB".
+func FormatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	v := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		v /= 1024
+		if v < 1024 {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f PiB", v/1024)
+}
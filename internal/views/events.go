@@ -0,0 +1,134 @@
+package views
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/basicauth"
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+const (
+	// proxies usually close idle connections after a minute
+	eventsKeepalive = 30 * time.Second
+)
+
+var (
+	// sequence numbers restart with the process, so event ids from a
+	// previous run must not be used to replay events.
+	eventsBoot = strconv.FormatInt(time.Now().UnixNano(), 36)
+)
+
+type eventEntry struct {
+	Type      filedata.EventType `json:"type"`
+	Timestamp time.Time          `json:"timestamp"`
+	File      *listEntry         `json:"file"`
+}
+
+func eventsLastSeq(r *http.Request) uint64 {
+	boot, seq, found := strings.Cut(r.Header.Get("Last-Event-ID"), "-")
+	if !found || boot != eventsBoot {
+		return 0
+	}
+	rv, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rv
+}
+
+// Events streams the file events as server-sent events, optionally filtered
+// by type. Clients that reconnect receive the events they missed, if still
+// available.
+func Events(w http.ResponseWriter, r *http.Request) {
+	// authentication
+	if !basicauth.BasicAuth(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	types := map[filedata.EventType]bool{}
+	for _, v := range r.URL.Query()["type"] {
+		switch t := filedata.EventType(v); t {
+		case filedata.EventUpload, filedata.EventUpdate, filedata.EventDelete, filedata.EventExpire:
+			types[t] = true
+		default:
+			utils.ErrorBadRequest(w)
+			return
+		}
+	}
+
+	s, err := settings.Get()
+	if err != nil {
+		utils.Error(w, err)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	events, cancel := filedata.Listen(eventsLastSeq(r))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := rc.Flush(); err != nil {
+		log.Printf("error: %s", err)
+		return
+	}
+
+	ticker := time.NewTicker(eventsKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+
+		case e, ok := <-events:
+			// the client was too slow and must reconnect, or the server is
+			// shutting down
+			if !ok {
+				return
+			}
+			if len(types) > 0 && !types[e.Type] {
+				continue
+			}
+
+			data, err := json.Marshal(&eventEntry{
+				Type:      e.Type,
+				Timestamp: e.Time,
+				File:      newListEntry(e.File, s.BaseUrl),
+			})
+			if err != nil {
+				log.Printf("error: %s", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", eventsBoot, e.Seq, e.Type, data); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
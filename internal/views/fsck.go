@@ -0,0 +1,142 @@
+package views
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/rafaelmartins/filebin/internal/basicauth"
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/fsck"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+type fsckEntry struct {
+	*fsck.Problem
+	Action fsck.Action `json:"action,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Fsck checks the backend for broken files. Problems are fixed on POST
+// requests, using the given action, optionally restricted to some ids.
+func Fsck(w http.ResponseWriter, r *http.Request) {
+	// authentication
+	if !basicauth.BasicAuth(w, r) {
+		return
+	}
+
+	action := fsck.Report
+	if r.Method == http.MethodPost {
+		var err error
+		action, err = fsck.ParseAction(r.FormValue("action"))
+		if err != nil || action == fsck.Report {
+			if err != nil {
+				log.Printf("error: %s", err)
+			}
+			utils.ErrorBadRequest(w)
+			return
+		}
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := listFormat(r)
+	if format == "" {
+		utils.ErrorBadRequest(w)
+		return
+	}
+
+	s, err := settings.Get()
+	if err != nil {
+		utils.Error(w, err)
+		return
+	}
+
+	known := map[string]int64{}
+	filedata.ForEach(func(fd *filedata.FileData) {
+		known[fd.GetId()] = fd.Size
+	})
+
+	problems, err := fsck.Check(r.Context(), s.Backend, r.FormValue("deep") == "1" || r.FormValue("deep") == "true", known)
+	if err != nil {
+		utils.Error(w, err)
+		return
+	}
+
+	ids := map[string]bool{}
+	for _, id := range r.Form["id"] {
+		ids[id] = true
+	}
+
+	entries := []*fsckEntry{}
+	for _, p := range problems {
+		e := &fsckEntry{Problem: p}
+		if action != fsck.Report && (len(ids) == 0 || ids[p.Id]) {
+			e.Action = action
+
+			fix := func() error {
+				return fsck.Fix(r.Context(), s.Backend, p, action)
+			}
+
+			// stale registries are refreshed, instead of deleting or
+			// quarantining healthy files
+			if action == fsck.Repair || p.Kind == fsck.StaleRegistry {
+				e.Action = fsck.Repair
+				if err := fix(); err != nil {
+					e.Error = err.Error()
+				} else if err := filedata.Refresh(r.Context(), p.Id); err != nil {
+					log.Printf("error: %s", err)
+				}
+			} else {
+				// quarantined or deleted files are dropped from the registry
+				if err := filedata.Remove(r.Context(), p.Id, fix); err != nil {
+					e.Error = err.Error()
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(struct {
+			Backend  string       `json:"backend"`
+			Problems []*fsckEntry `json:"problems"`
+		}{
+			Backend:  s.Backend.Name(),
+			Problems: entries,
+		}); err != nil {
+			utils.Error(w, err)
+		}
+
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				log.Printf("error: %s", err)
+				return
+			}
+		}
+
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s: %s: %s", e.Id, e.Kind, e.Detail)
+			if e.Action != fsck.Report {
+				if e.Error != "" {
+					fmt.Fprintf(w, " (%s failed: %s)", e.Action, e.Error)
+				} else {
+					fmt.Fprintf(w, " (%s done)", e.Action)
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package views
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/rafaelmartins/filebin/internal/basicauth"
+	"github.com/rafaelmartins/filebin/internal/search"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+const (
+	searchLimit = 50
+)
+
+var (
+	tmplSearch = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+<title>filebin — search</title>
+<style type="text/css">
+pre { margin: 0.2em 0 0.2em 1em; white-space: pre-wrap; word-break: break-all; }
+pre a { color: gray; text-decoration: none; }
+</style>
+</head>
+<body>
+<form method="get" action="/search">
+<input type="search" name="q" value="{{.Query}}" size="50" autofocus>
+<input type="submit" value="Search">
+</form>
+{{if .Query}}<p>{{len .Results}} result(s)</p>
+{{end}}{{range .Results}}<p>
+<a href="/{{.File.GetId}}">{{.File.GetFilename}}</a> ({{.File.Mimetype}}, {{.File.Timestamp.Format "02-01-2006 15:04:05"}})
+{{$id := .File.GetId}}{{range .Snippets}}<pre><a href="/{{$id}}#L{{.Line}}">{{.Line}}:</a> {{.Html}}</pre>
+{{end}}</p>
+{{end}}</body>
+</html>
+`))
+)
+
+type searchEntry struct {
+	*listEntry
+	*search.Result
+}
+
+func Search(w http.ResponseWriter, r *http.Request) {
+	// authentication
+	if !basicauth.BasicAuth(w, r) {
+		return
+	}
+
+	if !search.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	limit := searchLimit
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > searchLimit {
+			utils.ErrorBadRequest(w)
+			return
+		}
+	}
+
+	query := r.FormValue("q")
+
+	results := []*search.Result{}
+	if query != "" {
+		var err error
+		results, err = search.Search(r.Context(), query, limit)
+		if err != nil {
+			utils.Error(w, err)
+			return
+		}
+	}
+
+	format := listFormat(r)
+	switch format {
+	case "json", "ndjson":
+		baseUrl := ""
+		if s, err := settings.Get(); err == nil {
+			baseUrl = s.BaseUrl
+		}
+
+		d := []*searchEntry{}
+		for _, res := range results {
+			d = append(d, &searchEntry{
+				listEntry: newListEntry(res.File, baseUrl),
+				Result:    res,
+			})
+		}
+
+		if format == "ndjson" {
+			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+			enc := json.NewEncoder(w)
+			for _, e := range d {
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(d); err != nil {
+			utils.Error(w, err)
+		}
+
+	case "text":
+		dt := struct {
+			Query   string
+			Results []*search.Result
+		}{
+			Query:   query,
+			Results: results,
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmplSearch.Execute(w, dt); err != nil {
+			utils.Error(w, err)
+		}
+
+	default:
+		utils.ErrorBadRequest(w)
+	}
+}
@@ -0,0 +1,210 @@
+package views
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"github.com/rafaelmartins/filebin/internal/basicauth"
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/renderers"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"github.com/rafaelmartins/filebin/internal/utils"
+)
+
+const (
+	statsLargest = 10
+)
+
+var (
+	tmplStats = template.Must(template.New("stats").Funcs(template.FuncMap{
+		"size": utils.FormatSize,
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+<title>filebin — stats</title>
+<style type="text/css">
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 0.1em 0.8em; text-align: left; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<p>
+<strong>Backend:</strong> {{.Backend}}<br>
+<strong>Files:</strong> {{.Files}}<br>
+<strong>Size:</strong> {{size .Bytes}}
+</p>
+<h3>By mimetype</h3>
+<table>
+<tr><th>Mimetype</th><th>Files</th><th>Size</th></tr>
+{{range .Mimetypes}}<tr><td><a href="/list?mimetype={{.Name}}">{{.Name}}</a></td><td class="n">{{.Files}}</td><td class="n">{{size .Bytes}}</td></tr>
+{{end}}</table>
+<h3>By renderer</h3>
+<table>
+<tr><th>Renderer</th><th>Files</th><th>Size</th></tr>
+{{range .Renderers}}<tr><td>{{.Name}}</td><td class="n">{{.Files}}</td><td class="n">{{size .Bytes}}</td></tr>
+{{end}}</table>
+<h3>Uploads per day</h3>
+<table>
+<tr><th>Date</th><th>Files</th><th>Size</th></tr>
+{{range .Days}}<tr><td><a href="/list?since={{.Date}}&amp;until={{.Date}}">{{.Date}}</a></td><td class="n">{{.Files}}</td><td class="n">{{size .Bytes}}</td></tr>
+{{end}}</table>
+<h3>Largest files</h3>
+<table>
+<tr><th>File</th><th>Mimetype</th><th>Size</th><th>Uploaded</th></tr>
+{{range .Largest}}<tr><td><a href="/{{.Id}}">{{.GetFilename}}</a></td><td>{{.Mimetype}}</td><td class="n">{{size .Size}}</td><td>{{.Timestamp.Format "02-01-2006 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+)
+
+type statsCount struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type statsDay struct {
+	Date  string `json:"date"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type stats struct {
+	Backend   string        `json:"backend"`
+	Files     int           `json:"files"`
+	Bytes     int64         `json:"bytes"`
+	Mimetypes []*statsCount `json:"mimetypes"`
+	Renderers []*statsCount `json:"renderers"`
+	Days      []*statsDay   `json:"uploads_per_day"`
+	Largest   []*listEntry  `json:"largest"`
+}
+
+func sortedCounts(m map[string]*statsCount) []*statsCount {
+	rv := []*statsCount{}
+	for _, c := range m {
+		rv = append(rv, c)
+	}
+	sort.Slice(rv, func(i int, j int) bool {
+		if rv[i].Files != rv[j].Files {
+			return rv[i].Files > rv[j].Files
+		}
+		return rv[i].Name < rv[j].Name
+	})
+	return rv
+}
+
+func getStats(baseUrl string) *stats {
+	rv := &stats{}
+	if s, err := settings.Get(); err == nil && s.Backend != nil {
+		rv.Backend = s.Backend.Name()
+	}
+
+	mimetypes := map[string]*statsCount{}
+	rnds := map[string]*statsCount{}
+	days := map[string]*statsDay{}
+	largest := []*filedata.FileData{}
+
+	// looking up the renderer may be expensive, e.g. the highlight renderer
+	// tries to find a lexer, so the results are cached by mimetype.
+	rndByMimetype := map[string]string{}
+
+	filedata.ForEach(func(fd *filedata.FileData) {
+		rv.Files++
+		rv.Bytes += fd.Size
+
+		mc, ok := mimetypes[fd.Mimetype]
+		if !ok {
+			mc = &statsCount{Name: fd.Mimetype}
+			mimetypes[fd.Mimetype] = mc
+		}
+		mc.Files++
+		mc.Bytes += fd.Size
+
+		rn, ok := rndByMimetype[fd.Mimetype]
+		if !ok {
+			rn = "none"
+			if rnd, err := renderers.Lookup(fd.Mimetype); err == nil {
+				rn = rnd.Name()
+			}
+			rndByMimetype[fd.Mimetype] = rn
+		}
+		rc, ok := rnds[rn]
+		if !ok {
+			rc = &statsCount{Name: rn}
+			rnds[rn] = rc
+		}
+		rc.Files++
+		rc.Bytes += fd.Size
+
+		date := fd.Timestamp.UTC().Format("2006-01-02")
+		dc, ok := days[date]
+		if !ok {
+			dc = &statsDay{Date: date}
+			days[date] = dc
+		}
+		dc.Files++
+		dc.Bytes += fd.Size
+
+		largest = append(largest, fd)
+	})
+
+	rv.Mimetypes = sortedCounts(mimetypes)
+	rv.Renderers = sortedCounts(rnds)
+
+	rv.Days = []*statsDay{}
+	for _, d := range days {
+		rv.Days = append(rv.Days, d)
+	}
+	sort.Slice(rv.Days, func(i int, j int) bool {
+		return rv.Days[i].Date > rv.Days[j].Date
+	})
+
+	sort.SliceStable(largest, func(i int, j int) bool {
+		return largest[i].Size > largest[j].Size
+	})
+	if len(largest) > statsLargest {
+		largest = largest[:statsLargest]
+	}
+	rv.Largest = []*listEntry{}
+	for _, fd := range largest {
+		rv.Largest = append(rv.Largest, newListEntry(fd, baseUrl))
+	}
+
+	return rv
+}
+
+func Stats(w http.ResponseWriter, r *http.Request) {
+	// authentication
+	if !basicauth.BasicAuth(w, r) {
+		return
+	}
+
+	baseUrl := ""
+	if s, err := settings.Get(); err == nil {
+		baseUrl = s.BaseUrl
+	}
+
+	st := getStats(baseUrl)
+
+	switch listFormat(r) {
+	case "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			utils.Error(w, err)
+		}
+
+	case "text":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmplStats.Execute(w, st); err != nil {
+			utils.Error(w, err)
+		}
+
+	default:
+		utils.ErrorBadRequest(w)
+	}
+}
@@ -2,15 +2,22 @@ package views
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rafaelmartins/filebin/internal/access"
 	"github.com/rafaelmartins/filebin/internal/basicauth"
 	"github.com/rafaelmartins/filebin/internal/filedata"
 	"github.com/rafaelmartins/filebin/internal/highlight"
 	"github.com/rafaelmartins/filebin/internal/renderers"
+	"github.com/rafaelmartins/filebin/internal/renderers/archive"
+	"github.com/rafaelmartins/filebin/internal/renderers/raw"
 	"github.com/rafaelmartins/filebin/internal/settings"
 	"github.com/rafaelmartins/filebin/internal/utils"
 	"github.com/rafaelmartins/filebin/internal/version"
@@ -65,6 +72,11 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 	fds, err := filedata.NewFromRequest(r)
 	if err != nil {
 		if fds == nil {
+			if errors.Is(err, filedata.ErrInvalidMetadata) {
+				log.Printf("error: %s", err)
+				utils.ErrorBadRequest(w)
+				return
+			}
 			utils.Error(w, err)
 			return
 		}
@@ -105,12 +117,87 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func List(w http.ResponseWriter, r *http.Request) {
+func DirectUpload(w http.ResponseWriter, r *http.Request) {
 	// authentication
 	if !basicauth.BasicAuth(w, r) {
 		return
 	}
 
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil {
+		utils.ErrorBadRequest(w)
+		return
+	}
+
+	tags, err := filedata.ParseTags(r.Form["tags"])
+	if err != nil {
+		log.Printf("error: %s", err)
+		utils.ErrorBadRequest(w)
+		return
+	}
+
+	du, err := filedata.NewDirectUpload(r.Context(), r.FormValue("filename"), size, strings.TrimSpace(r.FormValue("description")), tags)
+	if err != nil {
+		if err == filedata.ErrDirectUploadUnsupported {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, filedata.ErrDirectUploadInvalid) || errors.Is(err, filedata.ErrInvalidMetadata) {
+			log.Printf("error: %s", err)
+			utils.ErrorBadRequest(w)
+			return
+		}
+		utils.Error(w, err)
+		return
+	}
+
+	baseUrl := ""
+	if s, err := settings.Get(); err == nil {
+		baseUrl = s.BaseUrl
+	}
+
+	d := struct {
+		*filedata.DirectUpload
+		FinalizeUrl string `json:"finalize_url"`
+	}{
+		DirectUpload: du,
+		FinalizeUrl:  fmt.Sprintf("%s/upload/%s/finalize", baseUrl, du.Id),
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		utils.Error(w, err)
+	}
+}
+
+func DirectUploadFinalize(w http.ResponseWriter, r *http.Request) {
+	// authentication
+	if !basicauth.BasicAuth(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	fd, err := filedata.FinalizeDirectUpload(r.Context(), id)
+	if err != nil {
+		if err == filedata.ErrNotFound || err == filedata.ErrDirectUploadUnsupported {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, filedata.ErrDirectUploadInvalid) {
+			log.Printf("error: %s", err)
+			utils.ErrorBadRequest(w)
+			return
+		}
+		utils.Error(w, err)
+		return
+	}
+
 	baseUrl := ""
 	if s, err := settings.Get(); err == nil {
 		baseUrl = s.BaseUrl
@@ -118,14 +205,218 @@ func List(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if baseUrl != "" {
+		fmt.Fprintf(w, "%s/%s\n", baseUrl, fd.GetId())
+	} else {
+		fmt.Fprintf(w, "%s\n", fd.GetId())
+	}
+}
 
-	filedata.ForEach(func(fd *filedata.FileData) {
-		if baseUrl != "" {
-			fmt.Fprintf(w, "%s: %s (%s) -> %s/%s\n", fd.Timestamp, fd.Filename, fd.Mimetype, baseUrl, fd.GetId())
-		} else {
-			fmt.Fprintf(w, "%s: %s (%s) -> %s\n", fd.Timestamp, fd.Filename, fd.Mimetype, fd.GetId())
+func parseDate(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	// dates without time cover the whole day
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+func parseListQuery(r *http.Request) (*filedata.Query, error) {
+	q := &filedata.Query{
+		Mimetype: r.FormValue("mimetype"),
+		Filename: r.FormValue("filename"),
+		Sort:     r.FormValue("sort"),
+		Cursor:   r.FormValue("cursor"),
+	}
+
+	var err error
+
+	q.Tags, err = filedata.ParseTags(r.Form["tag"])
+	if err != nil {
+		return nil, err
+	}
+
+	if v := r.FormValue("since"); v != "" {
+		q.Since, err = parseDate(v, false)
+		if err != nil {
+			return nil, err
 		}
-	})
+	}
+
+	if v := r.FormValue("until"); v != "" {
+		q.Until, err = parseDate(v, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := r.FormValue("min_size"); v != "" {
+		q.MinSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := r.FormValue("max_size"); v != "" {
+		q.MaxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch r.FormValue("order") {
+	case "", "asc":
+	case "desc":
+		q.Reverse = true
+	default:
+		return nil, errors.New("views: invalid order")
+	}
+
+	if v := r.FormValue("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+type listEntry struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	*filedata.FileData
+	Thumbnail string        `json:"thumbnail,omitempty"`
+	Access    *access.Stats `json:"access"`
+}
+
+func newListEntry(fd *filedata.FileData, baseUrl string) *listEntry {
+	rv := &listEntry{
+		Id:       fd.GetId(),
+		Url:      fmt.Sprintf("%s/%s", baseUrl, fd.GetId()),
+		FileData: fd,
+		Access:   access.Get(fd),
+	}
+	if filedata.SupportsThumbnail(fd.Mimetype) {
+		rv.Thumbnail = fmt.Sprintf("%s/%s/thumbnail", baseUrl, fd.GetId())
+	}
+	return rv
+}
+
+func listFormat(r *http.Request) string {
+	switch v := r.FormValue("format"); v {
+	case "json", "ndjson", "text":
+		return v
+	case "":
+	default:
+		return ""
+	}
+
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		return "json"
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) {
+		case "application/json":
+			return "json"
+		case "application/x-ndjson":
+			return "ndjson"
+		}
+	}
+
+	return "text"
+}
+
+func List(w http.ResponseWriter, r *http.Request) {
+	// authentication
+	if !basicauth.BasicAuth(w, r) {
+		return
+	}
+
+	q, err := parseListQuery(r)
+	if err != nil {
+		log.Printf("error: %s", err)
+		utils.ErrorBadRequest(w)
+		return
+	}
+
+	format := listFormat(r)
+	if format == "" {
+		utils.ErrorBadRequest(w)
+		return
+	}
+
+	fds, next, err := filedata.List(q)
+	if err != nil {
+		if errors.Is(err, filedata.ErrInvalidQuery) {
+			log.Printf("error: %s", err)
+			utils.ErrorBadRequest(w)
+			return
+		}
+		utils.Error(w, err)
+		return
+	}
+
+	baseUrl := ""
+	if s, err := settings.Get(); err == nil {
+		baseUrl = s.BaseUrl
+	}
+
+	if next != "" {
+		qs := r.URL.Query()
+		qs.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, baseUrl, r.URL.Path, qs.Encode()))
+	}
+
+	switch format {
+	case "json":
+		d := struct {
+			Files      []*listEntry `json:"files"`
+			NextCursor string       `json:"next_cursor,omitempty"`
+		}{
+			Files:      []*listEntry{},
+			NextCursor: next,
+		}
+		for _, fd := range fds {
+			d.Files = append(d.Files, newListEntry(fd, baseUrl))
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(d); err != nil {
+			utils.Error(w, err)
+		}
+
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		enc := json.NewEncoder(w)
+		for _, fd := range fds {
+			if err := enc.Encode(newListEntry(fd, baseUrl)); err != nil {
+				log.Printf("error: %s", err)
+				return
+			}
+		}
+
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		for _, fd := range fds {
+			st := access.Get(fd)
+			if baseUrl != "" {
+				fmt.Fprintf(w, "%s: %s (%s) [%d views, %d downloads] -> %s/%s\n", fd.Timestamp, fd.Filename, fd.Mimetype, st.Views, st.Downloads, baseUrl, fd.GetId())
+			} else {
+				fmt.Fprintf(w, "%s: %s (%s) [%d views, %d downloads] -> %s\n", fd.Timestamp, fd.Filename, fd.Mimetype, st.Views, st.Downloads, fd.GetId())
+			}
+		}
+	}
 }
 
 func Delete(w http.ResponseWriter, r *http.Request) {
@@ -141,7 +432,7 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := filedata.Delete(id); err != nil {
+	if err := filedata.Delete(r.Context(), id); err != nil {
 		if err == filedata.ErrNotFound {
 			http.NotFound(w, r)
 			return
@@ -159,7 +450,7 @@ func getFile(w http.ResponseWriter, r *http.Request) *filedata.FileData {
 		return nil
 	}
 
-	fd, err := filedata.NewFromId(id)
+	fd, err := filedata.NewFromId(r.Context(), id)
 	if err != nil {
 		if err == filedata.ErrNotFound {
 			http.NotFound(w, r)
@@ -180,8 +471,11 @@ func File(w http.ResponseWriter, r *http.Request) {
 	renderer, err := renderers.Lookup(fd.Mimetype)
 	if err != nil {
 		utils.Error(w, err)
+		return
 	}
 
+	access.Record(fd, access.View, r)
+
 	if err := renderer.Render(w, r, fd); err != nil {
 		utils.Error(w, err)
 	}
@@ -199,6 +493,8 @@ func FileText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	access.Record(fd, access.View, r)
+
 	if err := fd.Serve(w, r, fd.GetFilename(), "text/plain; charset=utf-8", fd.Timestamp, false); err != nil {
 		utils.Error(w, err)
 	}
@@ -210,18 +506,116 @@ func FileDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	access.Record(fd, access.Download, r)
+
 	if err := fd.Serve(w, r, fd.GetFilename(), fd.Mimetype, fd.Timestamp, true); err != nil {
 		utils.Error(w, err)
 	}
 }
 
+// FileRaw serves the file without any rendering. images, audio and video are
+// displayed inline, so that they can be embedded by renderers.
+func FileRaw(w http.ResponseWriter, r *http.Request) {
+	fd := getFile(w, r)
+	if fd == nil {
+		return
+	}
+
+	if err := (&raw.RawRenderer{}).Render(w, r, fd); err != nil {
+		utils.Error(w, err)
+	}
+}
+
+func FileThumbnail(w http.ResponseWriter, r *http.Request) {
+	fd := getFile(w, r)
+	if fd == nil {
+		return
+	}
+
+	if err := fd.ServeThumbnail(w, r); err != nil {
+		if errors.Is(err, filedata.ErrNoThumbnail) {
+			http.NotFound(w, r)
+			return
+		}
+		utils.Error(w, err)
+	}
+}
+
+// FileEntry renders a file extracted from an archive. The variants served by
+// the other file views are selected with the "view" parameter, because the
+// path of the entry may contain anything.
+func FileEntry(w http.ResponseWriter, r *http.Request) {
+	fd := getFile(w, r)
+	if fd == nil {
+		return
+	}
+
+	e, err := archive.Extract(r.Context(), fd, mux.Vars(r)["path"])
+	if err != nil {
+		if errors.Is(err, archive.ErrEntryNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, archive.ErrEntryTooLarge) {
+			http.Error(w, "413 entry too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, archive.ErrArchiveTooLarge) {
+			http.Error(w, "413 archive too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		utils.Error(w, err)
+		return
+	}
+
+	switch r.FormValue("view") {
+	case "":
+		renderer, err := renderers.Lookup(e.Mimetype)
+		if err != nil {
+			utils.Error(w, err)
+			return
+		}
+		err = renderer.Render(w, r, e)
+
+	case "raw":
+		err = (&raw.RawRenderer{}).Render(w, r, e)
+
+	case "download":
+		err = e.Serve(w, r, e.GetFilename(), e.Mimetype, e.Timestamp, true)
+
+	case "text":
+		lexer, lerr := highlight.GetLexer(e.Mimetype)
+		if lerr != nil || lexer == nil {
+			utils.ErrorBadRequest(w)
+			return
+		}
+		err = e.Serve(w, r, e.GetFilename(), "text/plain; charset=utf-8", e.Timestamp, false)
+
+	default:
+		utils.ErrorBadRequest(w)
+		return
+	}
+
+	if err != nil {
+		utils.Error(w, err)
+	}
+}
+
 func FileJSON(w http.ResponseWriter, r *http.Request) {
 	fd := getFile(w, r)
 	if fd == nil {
 		return
 	}
+	d := struct {
+		*filedata.FileData
+		Access *access.Stats `json:"access"`
+	}{
+		FileData: fd,
+		Access:   access.Get(fd),
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(w).Encode(fd); err != nil {
+	if err := json.NewEncoder(w).Encode(d); err != nil {
 		utils.Error(w, err)
 	}
 }
@@ -0,0 +1,227 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type delivery struct {
+	Id          string          `json:"id"`
+	Url         string          `json:"url"`
+	Event       string          `json:"event"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    uint            `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// outbox stores the deliveries in a directory until they succeed, so that
+// they survive restarts.
+type outbox struct {
+	dir    string
+	data   map[string]*delivery
+	notify map[string]chan struct{}
+	m      sync.Mutex
+}
+
+func newOutbox(dir string) (*outbox, error) {
+	rv := &outbox{
+		dir:    dir,
+		data:   map[string]*delivery{},
+		notify: map[string]chan struct{}{},
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0777); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		d := &delivery{}
+		if err := json.Unmarshal(data, d); err != nil || d.Id+".json" != file.Name() {
+			log.Printf("error: webhooks: ignoring invalid outbox file: %s", file.Name())
+			continue
+		}
+		rv.data[d.Id] = d
+	}
+	return rv, nil
+}
+
+// newDeliveryId returns ids that sort in creation order.
+func newDeliveryId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+func (o *outbox) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// save must be called with the lock held.
+func (o *outbox) save(d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	fp, err := ioutil.TempFile(o.dir, "."+d.Id+".")
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err2 := fp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), o.path(d.Id))
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return nil
+}
+
+// wake returns a channel that receives a value when a delivery to the url
+// is pushed.
+func (o *outbox) wake(u string) <-chan struct{} {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return o.wakeLocked(u)
+}
+
+func (o *outbox) wakeLocked(u string) chan struct{} {
+	ch, ok := o.notify[u]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		o.notify[u] = ch
+	}
+	return ch
+}
+
+func (o *outbox) push(d *delivery) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if err := o.save(d); err != nil {
+		return err
+	}
+	o.data[d.Id] = d
+
+	select {
+	case o.wakeLocked(d.Url) <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// urls returns the urls with pending deliveries, that may not be configured
+// anymore.
+func (o *outbox) urls() []string {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, d := range o.data {
+		if !seen[d.Url] {
+			seen[d.Url] = true
+			rv = append(rv, d.Url)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// next returns the oldest delivery to the url, if ready to be sent, and the
+// time of its next attempt otherwise, or zero if there are no deliveries.
+// deliveries to an url are sent in order, so newer ones wait for the retries
+// of the oldest one.
+func (o *outbox) next(u string, now time.Time) (*delivery, time.Time) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var head *delivery
+	for _, d := range o.data {
+		if d.Url == u && (head == nil || d.Id < head.Id) {
+			head = d
+		}
+	}
+
+	if head == nil {
+		return nil, time.Time{}
+	}
+	if head.NextAttempt.After(now) {
+		return nil, head.NextAttempt
+	}
+	return head, time.Time{}
+}
+
+func (o *outbox) done(d *delivery) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	delete(o.data, d.Id)
+	if err := os.Remove(o.path(d.Id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: webhooks: %s", err)
+	}
+}
+
+// fail moves deliveries that will not be retried anymore to the "failed"
+// subdirectory, for inspection.
+func (o *outbox) fail(d *delivery, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	d.Attempts++
+	d.LastError = strings.TrimSpace(err.Error())
+
+	delete(o.data, d.Id)
+	if err := o.save(d); err != nil {
+		log.Printf("error: webhooks: %s", err)
+	}
+	if err := os.Rename(o.path(d.Id), filepath.Join(o.dir, "failed", d.Id+".json")); err != nil {
+		log.Printf("error: webhooks: %s", err)
+	}
+}
+
+func (o *outbox) retry(d *delivery, next time.Time, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	d.Attempts++
+	d.NextAttempt = next
+	d.LastError = strings.TrimSpace(err.Error())
+	if err := o.save(d); err != nil {
+		log.Printf("error: webhooks: %s", err)
+	}
+}
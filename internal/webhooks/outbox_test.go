@@ -0,0 +1,84 @@
+package webhooks
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxReload(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := newOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, d := range []*delivery{
+		{Id: "0001", Url: "http://a", Event: "upload", Body: []byte(`{"a":1}`), NextAttempt: now},
+		{Id: "0002", Url: "http://a", Event: "delete", Body: []byte(`{"a":2}`), NextAttempt: now},
+		{Id: "0003", Url: "http://b", Event: "upload", Body: []byte(`{"b":1}`), NextAttempt: now},
+		{Id: "0004", Url: "http://c", Event: "upload", Body: []byte(`{"c":1}`), NextAttempt: now},
+	} {
+		if err := o.push(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.retry(o.data["0003"], now.Add(time.Minute), errors.New("boom"))
+	o.fail(o.data["0004"], errors.New("boom"))
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err = newOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(o.data); l != 3 {
+		t.Fatalf("unexpected number of deliveries: %d", l)
+	}
+	if d := o.data["0002"]; d == nil || d.Url != "http://a" || d.Event != "delete" || string(d.Body) != `{"a":2}` {
+		t.Errorf("unexpected delivery: %+v", d)
+	}
+	if d := o.data["0003"]; d == nil || d.Attempts != 1 || d.LastError != "boom" || !d.NextAttempt.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected retried delivery: %+v", d)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "0004.json")); err != nil {
+		t.Errorf("failed delivery not stored: %s", err)
+	}
+
+	// only the oldest delivery to each url is due
+	if urls := o.urls(); len(urls) != 2 || urls[0] != "http://a" || urls[1] != "http://b" {
+		t.Errorf("unexpected urls: %v", urls)
+	}
+
+	d, next := o.next("http://a", now)
+	if d == nil || d.Id != "0001" || !next.IsZero() {
+		t.Errorf("unexpected next delivery: %+v, %s", d, next)
+	}
+
+	d2, next := o.next("http://b", now)
+	if d2 != nil || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected next delivery: %+v, %s", d2, next)
+	}
+
+	if d, next := o.next("http://c", now); d != nil || !next.IsZero() {
+		t.Errorf("unexpected next delivery: %+v, %s", d, next)
+	}
+
+	o.done(d)
+	if _, err := os.Stat(filepath.Join(dir, "0001.json")); !os.IsNotExist(err) {
+		t.Errorf("delivered file not removed: %v", err)
+	}
+
+	d, _ = o.next("http://a", now)
+	if d == nil || d.Id != "0002" {
+		t.Errorf("unexpected next delivery: %+v", d)
+	}
+}
@@ -0,0 +1,306 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/settings"
+	"github.com/rafaelmartins/filebin/internal/version"
+)
+
+var (
+	minBackoff = 10 * time.Second
+	maxBackoff = time.Hour
+)
+
+type file struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	*filedata.FileData
+}
+
+type payload struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	File      *file     `json:"file"`
+}
+
+type webhooks struct {
+	urls        []string
+	secret      []byte
+	events      map[string]bool
+	baseUrl     string
+	maxAttempts uint
+	client      *http.Client
+	o           *outbox
+
+	// deliveries not stored in the outbox yet. events are emitted while
+	// handling requests, that must not wait for the disk.
+	queue  []*delivery
+	queued chan struct{}
+	m      sync.Mutex
+}
+
+var (
+	hooks *webhooks
+)
+
+func Init(ctx context.Context) error {
+	s, err := settings.Get()
+	if err != nil {
+		return err
+	}
+
+	if len(s.WebhookUrls) == 0 {
+		return nil
+	}
+
+	o, err := newOutbox(s.WebhookOutboxDir)
+	if err != nil {
+		return err
+	}
+
+	wh := newWebhooks(s.WebhookUrls, []byte(s.WebhookSecret), s.WebhookEvents, s.BaseUrl, s.WebhookMaxAttempts, s.WebhookTimeout, o)
+
+	hooks = wh
+	filedata.Subscribe(wh.handle)
+
+	go wh.writer(ctx)
+
+	// deliveries to urls removed from the settings are still sent. each url
+	// has its own worker, so that slow or failing receivers don't delay the
+	// others.
+	urls := map[string]bool{}
+	for _, u := range append(o.urls(), s.WebhookUrls...) {
+		if !urls[u] {
+			urls[u] = true
+			go wh.worker(ctx, u)
+		}
+	}
+	return nil
+}
+
+func newWebhooks(urls []string, secret []byte, events []string, baseUrl string, maxAttempts uint, timeout time.Duration, o *outbox) *webhooks {
+	rv := &webhooks{
+		urls:        urls,
+		secret:      secret,
+		events:      map[string]bool{},
+		baseUrl:     baseUrl,
+		maxAttempts: maxAttempts,
+		client:      &http.Client{Timeout: timeout},
+		o:           o,
+		queued:      make(chan struct{}, 1),
+	}
+	for _, e := range events {
+		rv.events[e] = true
+	}
+	return rv
+}
+
+// Close stores the queued deliveries in the outbox, so that they are sent
+// after a restart.
+func Close() error {
+	if hooks == nil {
+		return nil
+	}
+	return hooks.flush()
+}
+
+func (wh *webhooks) handle(e *filedata.Event) {
+	// the instance that handled the upload sends the notification
+	if e.Found || !wh.events[string(e.Type)] {
+		return
+	}
+
+	eid, err := newDeliveryId()
+	if err != nil {
+		log.Printf("error: webhooks: %s", err)
+		return
+	}
+
+	body, err := json.Marshal(&payload{
+		Id:        eid,
+		Type:      string(e.Type),
+		Timestamp: e.Time,
+		File: &file{
+			Id:       e.File.GetId(),
+			Url:      fmt.Sprintf("%s/%s", wh.baseUrl, e.File.GetId()),
+			FileData: e.File,
+		},
+	})
+	if err != nil {
+		log.Printf("error: webhooks: %s", err)
+		return
+	}
+
+	ds := make([]*delivery, 0, len(wh.urls))
+	for _, u := range wh.urls {
+		did, err := newDeliveryId()
+		if err != nil {
+			log.Printf("error: webhooks: %s", err)
+			return
+		}
+
+		ds = append(ds, &delivery{
+			Id:          did,
+			Url:         u,
+			Event:       string(e.Type),
+			Body:        body,
+			NextAttempt: e.Time,
+		})
+	}
+
+	wh.m.Lock()
+	wh.queue = append(wh.queue, ds...)
+	wh.m.Unlock()
+
+	select {
+	case wh.queued <- struct{}{}:
+	default:
+	}
+}
+
+// flush stores the queued deliveries in the outbox. deliveries that can't be
+// stored are lost, like before the queue existed.
+func (wh *webhooks) flush() error {
+	wh.m.Lock()
+	ds := wh.queue
+	wh.queue = nil
+	wh.m.Unlock()
+
+	var rv error
+	for _, d := range ds {
+		if err := wh.o.push(d); err != nil {
+			log.Printf("error: webhooks: %s: %s", d.Url, err)
+			rv = err
+		}
+	}
+	return rv
+}
+
+func (wh *webhooks) writer(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			wh.flush()
+			return
+		case <-wh.queued:
+			wh.flush()
+		}
+	}
+}
+
+// Sign returns the signature of a request body, sent in the
+// X-Filebin-Signature header.
+func Sign(secret []byte, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (wh *webhooks) send(ctx context.Context, d *delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Url, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "filebin/"+version.Version)
+	req.Header.Set("X-Filebin-Event", d.Event)
+	req.Header.Set("X-Filebin-Delivery", d.Id)
+	req.Header.Set("X-Filebin-Signature", Sign(wh.secret, d.Body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// allow the connection to be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func backoff(attempts uint) time.Duration {
+	rv := minBackoff
+	for i := uint(1); i < attempts && rv < maxBackoff; i++ {
+		rv *= 2
+	}
+	if rv > maxBackoff {
+		rv = maxBackoff
+	}
+	return rv
+}
+
+// worker sends the deliveries to an url, one at a time.
+func (wh *webhooks) worker(ctx context.Context, u string) {
+	wake := wh.o.wake(u)
+
+	for {
+		d, next := wh.o.next(u, time.Now())
+		if d != nil {
+			if err := ctx.Err(); err != nil {
+				return
+			}
+
+			err := wh.send(ctx, d)
+			if err == nil {
+				wh.o.done(d)
+				continue
+			}
+
+			// interrupted by the shutdown, not an attempt
+			if ctx.Err() != nil {
+				return
+			}
+
+			if d.Attempts+1 >= wh.maxAttempts {
+				log.Printf("error: webhooks: %s: %s: giving up after %d attempts: %s", d.Url, d.Id, d.Attempts+1, err)
+				wh.o.fail(d, err)
+				continue
+			}
+
+			log.Printf("error: webhooks: %s: %s: %s", d.Url, d.Id, err)
+			wh.o.retry(d, time.Now().Add(backoff(d.Attempts+1)), err)
+			continue
+		}
+
+		var (
+			t    *time.Timer
+			wait <-chan time.Time
+		)
+		if !next.IsZero() {
+			t = time.NewTimer(time.Until(next))
+			wait = t.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-wait:
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/filebin/internal/filedata"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '{"id":"foo"}' | openssl dgst -sha256 -hmac secret
+	const expected = "sha256=60868fd70007967e1ee47fd9a06180c5260416c96a338be842e18fc998d4308e"
+
+	if got := Sign([]byte("secret"), []byte(`{"id":"foo"}`)); got != expected {
+		t.Errorf("unexpected signature: got %s, expected %s", got, expected)
+	}
+	if got := Sign([]byte("other"), []byte(`{"id":"foo"}`)); got == expected {
+		t.Errorf("signature does not depend on secret")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attempts uint
+		expected time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{6, 320 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	} {
+		if got := backoff(tt.attempts); got != tt.expected {
+			t.Errorf("backoff(%d): got %s, expected %s", tt.attempts, got, tt.expected)
+		}
+	}
+}
+
+type receiver struct {
+	status []int
+	reqs   []*http.Request
+	bodies [][]byte
+	m      sync.Mutex
+	ch     chan struct{}
+}
+
+func newReceiver(status ...int) (*receiver, *httptest.Server) {
+	rv := &receiver{
+		status: status,
+		ch:     make(chan struct{}, 100),
+	}
+	return rv, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		rv.m.Lock()
+		rv.reqs = append(rv.reqs, r)
+		rv.bodies = append(rv.bodies, body)
+		st := http.StatusOK
+		if len(rv.status) > 0 {
+			st = rv.status[0]
+			rv.status = rv.status[1:]
+		}
+		rv.m.Unlock()
+
+		w.WriteHeader(st)
+		rv.ch <- struct{}{}
+	}))
+}
+
+func (r *receiver) wait(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-r.ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for delivery")
+	}
+}
+
+func newTestWebhooks(t *testing.T, urls ...string) *webhooks {
+	t.Helper()
+
+	o, err := newOutbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newWebhooks(urls, []byte("secret"), []string{"upload"}, "http://example.com", 3, 5*time.Second, o)
+}
+
+func TestSend(t *testing.T) {
+	r, srv := newReceiver(http.StatusOK, http.StatusInternalServerError)
+	defer srv.Close()
+
+	wh := newTestWebhooks(t, srv.URL)
+	d := &delivery{
+		Id:    "foo",
+		Url:   srv.URL,
+		Event: "upload",
+		Body:  []byte(`{"id":"foo"}`),
+	}
+
+	if err := wh.send(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if err := wh.send(context.Background(), d); err == nil {
+		t.Fatal("expected error for status 500")
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	req := r.reqs[0]
+	if v := req.Method; v != http.MethodPost {
+		t.Errorf("unexpected method: %s", v)
+	}
+	if v := req.Header.Get("Content-Type"); v != "application/json" {
+		t.Errorf("unexpected content type: %s", v)
+	}
+	if v := req.Header.Get("X-Filebin-Event"); v != "upload" {
+		t.Errorf("unexpected event: %s", v)
+	}
+	if v := req.Header.Get("X-Filebin-Delivery"); v != "foo" {
+		t.Errorf("unexpected delivery: %s", v)
+	}
+	if v := string(r.bodies[0]); v != `{"id":"foo"}` {
+		t.Errorf("unexpected body: %s", v)
+	}
+
+	// receivers verify the signature by computing it from the raw body
+	if v := req.Header.Get("X-Filebin-Signature"); !hmac.Equal([]byte(v), []byte(Sign([]byte("secret"), r.bodies[0]))) {
+		t.Errorf("invalid signature: %s", v)
+	}
+}
+
+func TestWorkerRetry(t *testing.T) {
+	oldMin, oldMax := minBackoff, maxBackoff
+	minBackoff, maxBackoff = 10*time.Millisecond, 100*time.Millisecond
+	defer func() {
+		minBackoff, maxBackoff = oldMin, oldMax
+	}()
+
+	r, srv := newReceiver(http.StatusInternalServerError, http.StatusBadGateway)
+	defer srv.Close()
+
+	wh := newTestWebhooks(t, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.worker(ctx, srv.URL)
+
+	if err := wh.o.push(&delivery{
+		Id:          "0001",
+		Url:         srv.URL,
+		Event:       "upload",
+		Body:        []byte(`{}`),
+		NextAttempt: time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.wait(t)
+	}
+
+	// the delivery is removed from the outbox by the worker after the
+	// successful attempt
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wh.o.m.Lock()
+		l := len(wh.o.data)
+		wh.o.m.Unlock()
+		if l == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("delivery not removed from outbox")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	files, err := ioutil.ReadDir(wh.o.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			t.Errorf("unexpected outbox file: %s", f.Name())
+		}
+	}
+}
+
+func TestWorkerGiveUp(t *testing.T) {
+	oldMin, oldMax := minBackoff, maxBackoff
+	minBackoff, maxBackoff = 10*time.Millisecond, 100*time.Millisecond
+	defer func() {
+		minBackoff, maxBackoff = oldMin, oldMax
+	}()
+
+	r, srv := newReceiver(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer srv.Close()
+
+	wh := newTestWebhooks(t, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.worker(ctx, srv.URL)
+
+	if err := wh.o.push(&delivery{
+		Id:          "0001",
+		Url:         srv.URL,
+		Event:       "upload",
+		Body:        []byte(`{}`),
+		NextAttempt: time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.wait(t)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o, err := newOutbox(wh.o.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadFile(o.path("failed/0001")); err == nil && len(o.data) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("delivery not moved to failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-r.ch:
+		t.Fatal("delivery retried after max attempts")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestHandleSkip(t *testing.T) {
+	wh := newTestWebhooks(t, "http://127.0.0.1")
+
+	// events handled by other instances, and events not subscribed, are
+	// not delivered
+	wh.handle(&filedata.Event{Type: filedata.EventUpload, Found: true})
+	wh.handle(&filedata.Event{Type: filedata.EventDelete})
+
+	if l := len(wh.queue); l != 0 {
+		t.Errorf("unexpected deliveries: %d", l)
+	}
+}
+
+func TestHandleQueue(t *testing.T) {
+	wh := newTestWebhooks(t, "http://a", "http://b")
+
+	// the outbox is only written by the writer, not while handling the
+	// request that emitted the event
+	wh.handle(&filedata.Event{Type: filedata.EventUpload, File: &filedata.FileData{}, Time: time.Now()})
+
+	if l := len(wh.queue); l != 2 {
+		t.Fatalf("unexpected queued deliveries: %d", l)
+	}
+	files, err := ioutil.ReadDir(wh.o.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(files); l != 1 {
+		t.Errorf("unexpected outbox files: %d", l)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wh.writer(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wh.o.m.Lock()
+		l := len(wh.o.data)
+		wh.o.m.Unlock()
+		if l == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("deliveries not stored in outbox")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// deliveries queued while shutting down are stored too
+	cancel()
+	<-done
+	wh.handle(&filedata.Event{Type: filedata.EventUpload, File: &filedata.FileData{}, Time: time.Now()})
+	if err := wh.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := newOutbox(wh.o.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(o.data); l != 4 {
+		t.Errorf("unexpected stored deliveries: %d", l)
+	}
+	if urls := o.urls(); len(urls) != 2 || urls[0] != "http://a" || urls[1] != "http://b" {
+		t.Errorf("unexpected urls: %v", urls)
+	}
+}
+
+func TestWorkerIndependent(t *testing.T) {
+	// a receiver that hangs, and one that fails, must not delay the
+	// deliveries to a healthy receiver
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+
+	fr, failing := newReceiver(http.StatusInternalServerError)
+	defer failing.Close()
+
+	r, srv := newReceiver()
+	defer srv.Close()
+
+	wh := newTestWebhooks(t, slow.URL, failing.URL, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	for _, u := range wh.urls {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			wh.worker(ctx, u)
+		}(u)
+	}
+	defer wg.Wait()
+	defer cancel()
+
+	for i, u := range []string{slow.URL, slow.URL, failing.URL, failing.URL} {
+		if err := wh.o.push(&delivery{
+			Id:          fmt.Sprintf("%04d", i),
+			Url:         u,
+			Event:       "upload",
+			Body:        []byte(`{}`),
+			NextAttempt: time.Now(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr.wait(t)
+
+	for i := 0; i < 2; i++ {
+		if err := wh.o.push(&delivery{
+			Id:          fmt.Sprintf("%04d", 10+i),
+			Url:         srv.URL,
+			Event:       "upload",
+			Body:        []byte(`{}`),
+			NextAttempt: time.Now(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		r.wait(t)
+	}
+}
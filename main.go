@@ -1,21 +1,39 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/rafaelmartins/filebin/internal/access"
 	"github.com/rafaelmartins/filebin/internal/filedata"
+	"github.com/rafaelmartins/filebin/internal/filedata/backends"
+	"github.com/rafaelmartins/filebin/internal/fsck"
+	"github.com/rafaelmartins/filebin/internal/migrate"
 	"github.com/rafaelmartins/filebin/internal/mime/magic"
+	"github.com/rafaelmartins/filebin/internal/search"
 	"github.com/rafaelmartins/filebin/internal/settings"
 	"github.com/rafaelmartins/filebin/internal/views"
+	"github.com/rafaelmartins/filebin/internal/webhooks"
 )
 
 func usage(err error) {
 	fmt.Fprintln(os.Stderr, "usage: filebin")
+	fmt.Fprintln(os.Stderr, "       filebin migrate --from BACKEND --to BACKEND")
+	fmt.Fprintln(os.Stderr, "       filebin fsck --backend BACKEND [--deep] [--action repair|quarantine|delete]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "backends: local:/path/to/dir, s3, azure, gcs, sftp")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "error:", err.Error())
@@ -42,7 +60,110 @@ func logHandler(w io.Writer, params handlers.LogFormatterParams) {
 	)
 }
 
+func lookupSpec(spec string) (backends.Backend, error) {
+	s3Options, err := settings.GetS3Options()
+	if err != nil {
+		return nil, err
+	}
+
+	azureOptions, err := settings.GetAzureOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	gcsOptions, err := settings.GetGCSOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	sftpOptions, err := settings.GetSFTPOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	return backends.LookupSpec(spec, s3Options, azureOptions, gcsOptions, sftpOptions)
+}
+
+func cmdMigrate(args []string) {
+	f := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	from := f.String("from", "", "")
+	to := f.String("to", "", "")
+	if err := f.Parse(args); err != nil {
+		usage(err)
+	}
+	if *from == "" || *to == "" {
+		usage(errors.New("migrate: --from and --to are required"))
+	}
+	if *from == *to {
+		usage(errors.New("migrate: --from and --to must be different"))
+	}
+
+	fromBackend, err := lookupSpec(*from)
+	if err != nil {
+		usage(err)
+	}
+
+	toBackend, err := lookupSpec(*to)
+	if err != nil {
+		usage(err)
+	}
+
+	if err := migrate.Migrate(context.Background(), fromBackend, toBackend, os.Stdout); err != nil {
+		usage(err)
+	}
+}
+
+func cmdFsck(args []string) {
+	f := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	backend := f.String("backend", "", "")
+	deep := f.Bool("deep", false, "")
+	action := f.String("action", "", "")
+	if err := f.Parse(args); err != nil {
+		usage(err)
+	}
+	if *backend == "" {
+		usage(errors.New("fsck: --backend is required"))
+	}
+
+	a, err := fsck.ParseAction(*action)
+	if err != nil {
+		usage(err)
+	}
+
+	b, err := lookupSpec(*backend)
+	if err != nil {
+		usage(err)
+	}
+
+	// required to detect the mimetype of files without metadata
+	if err := magic.Init(); err != nil {
+		usage(err)
+	}
+	defer magic.Close()
+
+	if err := fsck.Run(context.Background(), b, *deep, a, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err.Error())
+		magic.Close()
+		os.Exit(1)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			cmdMigrate(os.Args[2:])
+			return
+		case "fsck":
+			cmdFsck(os.Args[2:])
+			return
+		default:
+			usage(fmt.Errorf("invalid command: %s", os.Args[1]))
+		}
+	}
+
 	s, err := settings.Get()
 	if err != nil {
 		usage(err)
@@ -52,10 +173,21 @@ func main() {
 	r.HandleFunc("/", views.Upload).Methods("POST")
 	r.HandleFunc("/", views.Index)
 	r.HandleFunc("/robots.txt", views.Robots)
+	r.HandleFunc("/upload", views.DirectUpload).Methods("POST")
+	r.HandleFunc("/upload/{id}/finalize", views.DirectUploadFinalize).Methods("POST")
 	r.HandleFunc("/list", views.List)
+	r.HandleFunc("/list.json", views.List)
+	r.HandleFunc("/search", views.Search)
+	r.HandleFunc("/stats", views.Stats)
+	r.HandleFunc("/stats.json", views.Stats)
+	r.HandleFunc("/admin/fsck", views.Fsck)
+	r.HandleFunc("/events", views.Events)
 	r.HandleFunc("/{id}.json", views.FileJSON)
 	r.HandleFunc("/{id}.txt", views.FileText)
 	r.HandleFunc("/{id}/download", views.FileDownload)
+	r.HandleFunc("/{id}/raw", views.FileRaw)
+	r.HandleFunc("/{id}/thumbnail", views.FileThumbnail)
+	r.HandleFunc("/{id}/entry/{path:.+}", views.FileEntry)
 	r.HandleFunc("/{id}", views.Delete).Methods("DELETE")
 	r.HandleFunc("/{id}", views.File)
 
@@ -67,12 +199,61 @@ func main() {
 	}
 	defer magic.Close()
 
-	if err := filedata.Init(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := filedata.Init(ctx); err != nil {
 		usage(err)
 	}
 
+	if err := search.Init(ctx); err != nil {
+		usage(err)
+	}
+
+	if err := access.Init(ctx); err != nil {
+		usage(err)
+	}
+
+	if err := webhooks.Init(ctx); err != nil {
+		usage(err)
+	}
+
+	srv := &http.Server{
+		Addr:    s.ListenAddr,
+		Handler: h,
+	}
+
+	// Shutdown does not cancel the requests in progress, and event streams
+	// would only finish after the timeout
+	srv.RegisterOnShutdown(filedata.CloseListeners)
+
+	// state kept in memory is saved after the requests in progress finish
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Printf("error: %s", err)
+		}
+	}()
+
 	fmt.Fprintf(os.Stderr, " * Listening on %s (backend: %s)\n", s.ListenAddr, s.Backend.Name())
-	if err := http.ListenAndServe(s.ListenAddr, h); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		usage(err)
 	}
+	<-done
+
+	if err := search.Close(); err != nil {
+		log.Printf("error: search: %s", err)
+	}
+
+	if err := access.Close(); err != nil {
+		log.Printf("error: access: %s", err)
+	}
+
+	if err := webhooks.Close(); err != nil {
+		log.Printf("error: webhooks: %s", err)
+	}
 }